@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenAdmin listens on the given admin API address. Addresses of the form unix:/path/to/socket
+// listen on a unix domain socket with mode --admin_socket_mode; anything else is a TCP address.
+func listenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	mode, err := strconv.ParseUint(*adminSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %v", *adminSocketMode, err)
+	}
+
+	// Remove a socket left behind by a previous run, but nothing else.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %q: %v", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not set mode of %q: %v", path, err)
+	}
+	return listener, nil
+}
+
+type feedStatus struct {
+	Name      string    `json:"name"`
+	LastCheck time.Time `json:"lastCheck"`
+	NextCheck time.Time `json:"nextCheck"`
+	Checking  bool      `json:"checking"`
+}
+
+func adminHandler(watchers map[string]*watcher) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feeds", func(w http.ResponseWriter, r *http.Request) {
+		var statuses []feedStatus
+		for name, wt := range watchers {
+			wt.mu.Lock()
+			statuses = append(statuses, feedStatus{
+				Name:      name,
+				LastCheck: wt.lastCheck,
+				NextCheck: wt.nextCheck,
+				Checking:  wt.cancel != nil,
+			})
+			wt.mu.Unlock()
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+		writeJSON(w, statuses)
+	})
+	mux.HandleFunc("/errors", func(w http.ResponseWriter, r *http.Request) {
+		feedErrors, err := recentErrors(r.FormValue("feed"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, feedErrors)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusMetrics(w)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// migrations holds the statements that bring a database up to the current schema. The schema
+// version is stored in SQLite's user_version pragma; migrations[i] upgrades a database at version
+// i to version i+1. Only ever append to this list.
+var migrations = []string{
+	// Version 1: the original schema.
+	`CREATE TABLE IF NOT EXISTS feeds (name TEXT PRIMARY KEY, url TEXT NOT NULL,
+		dayOfWeek INTEGER NOT NULL, seconds INTEGER NOT NULL, lastTitle TEXT NOT NULL);`,
+
+	// Version 2: per-feed include filters, and a cache of each feed's most recently fetched items.
+	`ALTER TABLE feeds ADD COLUMN include TEXT NOT NULL DEFAULT '';
+	CREATE TABLE feedItems (feed TEXT NOT NULL, position INTEGER NOT NULL, title TEXT NOT NULL,
+		url TEXT NOT NULL, filtered INTEGER NOT NULL, PRIMARY KEY (feed, position));`,
+
+	// Version 3: per-feed modes.
+	`ALTER TABLE feeds ADD COLUMN mode TEXT NOT NULL DEFAULT 'download';`,
+
+	// Version 4: per-feed title normalization rules.
+	`ALTER TABLE feeds ADD COLUMN titleStrip TEXT NOT NULL DEFAULT '';`,
+
+	// Version 5: daily per-feed download statistics, and a view totalling them across feeds.
+	`CREATE TABLE dailyStats (day TEXT NOT NULL, feed TEXT NOT NULL, downloads INTEGER NOT NULL,
+		bytes INTEGER NOT NULL, failures INTEGER NOT NULL, PRIMARY KEY (day, feed));
+	CREATE VIEW dailyTotals AS SELECT day, SUM(downloads) AS downloads, SUM(bytes) AS bytes,
+		SUM(failures) AS failures FROM dailyStats GROUP BY day;`,
+
+	// Version 6: per-feed success & failure hooks.
+	`ALTER TABLE feeds ADD COLUMN onSuccess TEXT NOT NULL DEFAULT '';
+	ALTER TABLE feeds ADD COLUMN onFailure TEXT NOT NULL DEFAULT '';`,
+
+	// Version 7: per-feed download directories.
+	`ALTER TABLE feeds ADD COLUMN directory TEXT NOT NULL DEFAULT '';`,
+
+	// Version 8: per-feed expected number of items per rapid window.
+	`ALTER TABLE feeds ADD COLUMN expectedItems INTEGER NOT NULL DEFAULT 0;`,
+
+	// Version 9: a bounded log of each feed's recent errors.
+	`CREATE TABLE feedErrors (id INTEGER PRIMARY KEY AUTOINCREMENT, feed TEXT NOT NULL,
+		time INTEGER NOT NULL, category TEXT NOT NULL, message TEXT NOT NULL);
+	CREATE INDEX feedErrorsByFeed ON feedErrors (feed, id);`,
+
+	// Version 10: recent publication-to-download latencies of each feed.
+	`CREATE TABLE latencies (id INTEGER PRIMARY KEY AUTOINCREMENT, feed TEXT NOT NULL,
+		completed INTEGER NOT NULL, seconds REAL NOT NULL);
+	CREATE INDEX latenciesByFeed ON latencies (feed, id);`,
+
+	// Version 11: item-level seen state, which may also be imported from other tools.
+	`CREATE TABLE seenItems (feed TEXT NOT NULL, title TEXT NOT NULL, guid TEXT NOT NULL,
+		PRIMARY KEY (feed, title, guid));
+	CREATE INDEX seenItemsByGUID ON seenItems (feed, guid);`,
+
+	// Version 12: an outbox of events waiting to be published.
+	`CREATE TABLE eventOutbox (id INTEGER PRIMARY KEY AUTOINCREMENT, eventId TEXT NOT NULL,
+		message TEXT NOT NULL);`,
+}
+
+// db is the database connection shared by the daemon and the command-line operations.
+var db *sql.DB
+
+func schemaVersion() (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("could not read schema version: %v", err)
+	}
+	return version, nil
+}
+
+func migrateDB() error {
+	version, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this version of rss-download supports (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("could not migrate schema to version %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not migrate schema to version %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not migrate schema to version %d: %v", version+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("could not migrate schema to version %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+// feedMode determines what is done with the new items of a feed.
+type feedMode string
+
+const (
+	modeDownload feedMode = "download" // download new items & run the update command
+	modeNotify   feedMode = "notify"   // run the update command, but do not download new items
+	modeRecord   feedMode = "record"   // only record that new items have been seen
+)
+
+// feed is the configuration & state of a single watched feed.
+type feed struct {
+	name          string
+	url           string
+	dayOfWeek     int
+	seconds       int
+	lastTitle     string
+	include       *regexp.Regexp // nil if every item should be downloaded
+	mode          feedMode
+	strip         []*regexp.Regexp   // patterns removed from titles before they are compared or stored
+	onSuccess     string             // command to run after an item is downloaded
+	onFailure     string             // command to run after an item fails to download
+	directory     *template.Template // download directory, relative to the target; nil for the target itself
+	expectedItems int                // number of new items expected per rapid window; 0 if unknown
+}
+
+// normalizeTitle applies the feed's title normalization rules to the given title.
+func (f *feed) normalizeTitle(title string) string {
+	if len(f.strip) == 0 {
+		return title
+	}
+	for _, re := range f.strip {
+		title = re.ReplaceAllString(title, "")
+	}
+	return strings.TrimSpace(title)
+}
+
+// matches determines if an item with the given title passes the feed's filters.
+func (f *feed) matches(title string) bool {
+	return f.include == nil || f.include.MatchString(title)
+}
+
+// configure validates & applies the parts of a feed's configuration which need parsing.
+func (f *feed) configure(include, titleStrip, directory string) error {
+	if u, err := url.Parse(f.url); err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: must be an absolute http or https url", f.url)
+	}
+	switch f.mode {
+	case modeDownload, modeNotify, modeRecord:
+	default:
+		return fmt.Errorf("invalid mode %q", f.mode)
+	}
+	if f.expectedItems < 0 {
+		return fmt.Errorf("invalid expected items %d: must not be negative", f.expectedItems)
+	}
+	if include != "" {
+		var err error
+		if f.include, err = regexp.Compile(include); err != nil {
+			return fmt.Errorf("invalid include filter: %v", err)
+		}
+	}
+	for _, pattern := range strings.Split(titleStrip, "\n") {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid title strip pattern: %v", err)
+		}
+		f.strip = append(f.strip, re)
+	}
+	if directory != "" {
+		var err error
+		sample := directoryData{Feed: f.name, Title: "Sample Title S01E01 [1080p]", Time: time.Now()}
+		if f.directory, err = parseTemplate(f.name, directory, sample); err != nil {
+			return fmt.Errorf("invalid directory template: %v", err)
+		}
+	}
+	// Titles stored before the rules were added (or changed) must be normalized too.
+	f.lastTitle = f.normalizeTitle(f.lastTitle)
+	return nil
+}
+
+// loadFeeds reads the configuration of every feed. If some feeds are misconfigured, the valid
+// feeds are returned along with an error describing every misconfigured feed.
+func loadFeeds() ([]*feed, error) {
+	rows, err := db.Query("SELECT name, url, dayOfWeek, seconds, lastTitle, include, mode, titleStrip, onSuccess, onFailure, directory, expectedItems FROM feeds")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []*feed
+	var problems []string
+	for rows.Next() {
+		var f feed
+		var include, titleStrip, directory string
+		if err := rows.Scan(&f.name, &f.url, &f.dayOfWeek, &f.seconds, &f.lastTitle, &include, &f.mode, &titleStrip, &f.onSuccess, &f.onFailure, &directory, &f.expectedItems); err != nil {
+			return nil, err
+		}
+		if err := f.configure(include, titleStrip, directory); err != nil {
+			problems = append(problems, fmt.Sprintf("[%s] %v", f.name, err))
+			continue
+		}
+		feeds = append(feeds, &f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return feeds, fmt.Errorf("%d misconfigured feeds: %s", len(problems), strings.Join(problems, "; "))
+	}
+	return feeds, nil
+}
+
+// cachedItem is an item from the most recent check of a feed.
+type cachedItem struct {
+	position int
+	title    string
+	url      string
+	filtered bool // true if the item was new, but was not downloaded due to the feed's filters
+}
+
+// cacheItems replaces the cached items for the given feed. Items which were filtered out by an
+// earlier check (matched by title or URL) remain filtered, so that they can still be rechecked
+// once later checks have seen them.
+func cacheItems(name string, items []cachedItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	filteredTitles, filteredURLs, err := previouslyFiltered(tx, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM feedItems WHERE feed = ?", name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, item := range items {
+		filtered := item.filtered || filteredTitles[item.title] || (item.url != "" && filteredURLs[item.url])
+		if _, err := tx.Exec("INSERT INTO feedItems (feed, position, title, url, filtered) VALUES (?, ?, ?, ?, ?)",
+			name, item.position, item.title, item.url, filtered); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// previouslyFiltered returns the titles & URLs of the given feed's cached items that were filtered
+// out.
+func previouslyFiltered(tx *sql.Tx, name string) (map[string]bool, map[string]bool, error) {
+	rows, err := tx.Query("SELECT title, url FROM feedItems WHERE feed = ? AND filtered = 1", name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	titles, urls := make(map[string]bool), make(map[string]bool)
+	for rows.Next() {
+		var title, url string
+		if err := rows.Scan(&title, &url); err != nil {
+			return nil, nil, err
+		}
+		titles[title], urls[url] = true, true
+	}
+	return titles, urls, rows.Err()
+}
+
+// filteredItems returns the cached items for the given feed that were filtered out.
+func filteredItems(name string) ([]cachedItem, error) {
+	rows, err := db.Query("SELECT position, title, url FROM feedItems WHERE feed = ? AND filtered = 1 ORDER BY position", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []cachedItem
+	for rows.Next() {
+		item := cachedItem{filtered: true}
+		if err := rows.Scan(&item.position, &item.title, &item.url); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// isSeen determines if an item of the given feed has been seen before, either by title or by GUID
+// (which may have been recorded from the item's GUID or its link).
+func isSeen(name string, title string, guid string, link string) (bool, error) {
+	var seen int
+	err := db.QueryRow(`SELECT COUNT(*) FROM seenItems WHERE feed = ? AND
+		(title = ? OR (guid != '' AND guid IN (?, ?)))`, name, title, guid, link).Scan(&seen)
+	return seen > 0, err
+}
+
+// markSeen records that an item of the given feed has been seen.
+func markSeen(name string, title string, guid string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO seenItems (feed, title, guid) VALUES (?, ?, ?)", name, title, guid)
+	return err
+}
+
+// recordDailyStats adds a download attempt to the given feed's statistics for the current day.
+func recordDailyStats(name string, bytes int64, failed bool) error {
+	downloads, failures := 1, 0
+	if failed {
+		downloads, failures = 0, 1
+	}
+	_, err := db.Exec(`INSERT INTO dailyStats (day, feed, downloads, bytes, failures) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (day, feed) DO UPDATE SET downloads = downloads + excluded.downloads,
+			bytes = bytes + excluded.bytes, failures = failures + excluded.failures`,
+		time.Now().Format("2006-01-02"), name, downloads, bytes, failures)
+	return err
+}
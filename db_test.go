@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// useTestDB points db at a freshly migrated database for the duration of the test.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	var err error
+	if db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "feeds.db")); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateDB(); err != nil {
+		t.Fatalf("Could not migrate database: %v", err)
+	}
+}
+
+func TestCacheItemsKeepsFiltered(t *testing.T) {
+	useTestDB(t)
+
+	if err := cacheItems("feed", []cachedItem{
+		{position: 0, title: "Filtered", url: "http://example.com/filtered", filtered: true},
+		{position: 1, title: "Downloaded", url: "http://example.com/downloaded"},
+	}); err != nil {
+		t.Fatalf("cacheItems: %v", err)
+	}
+	// A later check sees the same items (one of them renamed) as old items, which it did not filter.
+	if err := cacheItems("feed", []cachedItem{
+		{position: 0, title: "New", url: "http://example.com/new"},
+		{position: 1, title: "Filtered (renamed)", url: "http://example.com/filtered"},
+		{position: 2, title: "Downloaded", url: "http://example.com/downloaded"},
+	}); err != nil {
+		t.Fatalf("cacheItems: %v", err)
+	}
+
+	items, err := filteredItems("feed")
+	if err != nil {
+		t.Fatalf("filteredItems: %v", err)
+	}
+	if len(items) != 1 || items[0].position != 1 || items[0].title != "Filtered (renamed)" {
+		t.Errorf("filteredItems = %+v, want only the renamed filtered item at position 1", items)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"time"
+)
+
+// directoryData is the data available to directory templates.
+type directoryData struct {
+	Feed  string    // name of the feed
+	Title string    // normalized title of the item
+	Time  time.Time // time the item is downloaded
+}
+
+func parseDirMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(*dirMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid directory mode %q: %v", *dirMode, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+// downloadDir determines the directory that the given item of the feed should be downloaded to,
+// creating it if necessary.
+func (f *feed) downloadDir(title string) (string, error) {
+	if f.directory == nil {
+		return *target, nil
+	}
+
+	var buf bytes.Buffer
+	if err := f.directory.Execute(&buf, directoryData{Feed: f.name, Title: title, Time: time.Now()}); err != nil {
+		return "", fmt.Errorf("could not determine download directory: %v", err)
+	}
+	dir, err := targetSubdir(buf.String())
+	if err != nil {
+		return "", err
+	}
+	if err := makeDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// sanitizePathComponent returns a version of s that is safe to use as a single path component:
+// runes for which unsafe returns true are replaced with '_', and names with special meanings (the
+// empty name, "." and "..") are prefixed with '_'.
+func sanitizePathComponent(s string, unsafe func(rune) bool) string {
+	safe := strings.Map(func(r rune) rune {
+		if unsafe(r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if safe == "" || safe == "." || safe == ".." {
+		safe = "_" + safe
+	}
+	return safe
+}
+
+// targetSubdir returns the path of the given directory relative to the target directory, as long
+// as it does not escape the target directory.
+func targetSubdir(rel string) (string, error) {
+	dir := filepath.Join(*target, rel)
+	if r, err := filepath.Rel(*target, dir); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("download directory %q is outside of the target directory", rel)
+	}
+	return dir, nil
+}
+
+func makeDir(dir string) error {
+	mode, err := parseDirMode()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("could not create directory %q: %v", dir, err)
+	}
+	return nil
+}
+
+// checkDirectory creates the feed's download directory & verifies that it is writable. For
+// templated directories, only the part of the path before the first template action can be
+// checked ahead of time.
+func (f *feed) checkDirectory() error {
+	if f.directory == nil {
+		return nil
+	}
+	var static string
+	nodes := f.directory.Root.Nodes
+	if len(nodes) > 0 {
+		if text, ok := nodes[0].(*parse.TextNode); ok {
+			static = string(text.Text)
+		}
+	}
+	if len(nodes) > 1 || (len(nodes) == 1 && static == "") {
+		// Only the directories entirely before the first action are known.
+		static = filepath.Dir(static + "x")
+	}
+	dir, err := targetSubdir(static)
+	if err != nil {
+		return err
+	}
+	if err := makeDir(dir); err != nil {
+		return err
+	}
+	return checkWritableDir(dir)
+}
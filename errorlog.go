@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// feedError is an entry in the feedErrors table.
+type feedError struct {
+	Feed     string    `json:"feed"`
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+}
+
+// checkErrorRetention verifies that --error_retention keeps a bounded, nonempty error log.
+func checkErrorRetention() error {
+	if *errorRetention <= 0 {
+		return fmt.Errorf("--error_retention must be positive, got %d", *errorRetention)
+	}
+	return nil
+}
+
+// recordError adds an error to the given feed's error log, discarding the feed's oldest errors
+// beyond --error_retention. The error is expected to have been logged already.
+func recordError(name string, category string, err error) {
+	if _, dbErr := db.Exec("INSERT INTO feedErrors (feed, time, category, message) VALUES (?, ?, ?, ?)",
+		name, time.Now().Unix(), category, err.Error()); dbErr != nil {
+		log.Printf("[%s] Error recording error: %s", name, dbErr)
+		return
+	}
+	if _, dbErr := db.Exec(`DELETE FROM feedErrors WHERE feed = ? AND id NOT IN
+		(SELECT id FROM feedErrors WHERE feed = ? ORDER BY id DESC LIMIT ?)`,
+		name, name, *errorRetention); dbErr != nil {
+		log.Printf("[%s] Error trimming error log: %s", name, dbErr)
+	}
+}
+
+// recentErrors returns the logged errors of the given feed (or of every feed, if name is empty),
+// oldest first.
+func recentErrors(name string) ([]feedError, error) {
+	query := "SELECT feed, time, category, message FROM feedErrors ORDER BY id"
+	var args []interface{}
+	if name != "" {
+		query = "SELECT feed, time, category, message FROM feedErrors WHERE feed = ? ORDER BY id"
+		args = append(args, name)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feedErrors := []feedError{}
+	for rows.Next() {
+		var fe feedError
+		var unixTime int64
+		if err := rows.Scan(&fe.Feed, &unixTime, &fe.Category, &fe.Message); err != nil {
+			return nil, err
+		}
+		fe.Time = time.Unix(unixTime, 0)
+		feedErrors = append(feedErrors, fe)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return feedErrors, nil
+}
+
+// showErrors prints the logged errors of the named feed, or of every feed if no name is given.
+func showErrors(args []string) {
+	if len(args) > 1 {
+		log.Fatal("Usage: errors [feed]")
+	}
+	var name string
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	feedErrors, err := recentErrors(name)
+	if err != nil {
+		log.Fatalf("Error reading error log: %s", err)
+	}
+	for _, fe := range feedErrors {
+		fmt.Printf("%s [%s] %s: %s\n", fe.Time.Format("2006-01-02 15:04:05"), fe.Feed, fe.Category, fe.Message)
+	}
+}
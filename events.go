@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventsPollInterval is how often the outbox is checked for events added by other processes (e.g.
+// the recheck & inject commands).
+const eventsPollInterval = 30 * time.Second
+
+// event describes the outcome of a download, for consumption by other services.
+type event struct {
+	ID       string    `json:"id"`   // unique ID, with which consumers can discard redelivered events
+	Type     string    `json:"type"` // "download" or "download_failed"
+	Feed     string    `json:"feed"`
+	Title    string    `json:"title"`
+	URL      string    `json:"url"`
+	Path     string    `json:"path,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	Error    string    `json:"error,omitempty"`
+	Injected bool      `json:"injected,omitempty"` // true if the item was injected by the inject command
+	Time     time.Time `json:"time"`
+}
+
+// signedEvent is the message actually published. If --events_secret is set, Signature is the
+// hex-encoded HMAC-SHA256 of Event (exactly as it appears in the message) keyed by the secret.
+type signedEvent struct {
+	Event     json.RawMessage `json:"event"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// eventPublisher publishes messages to an external queue. publish only succeeds once the server
+// has durably accepted the message.
+type eventPublisher interface {
+	publish(id string, msg []byte) error
+	close() error
+}
+
+// eventsPending is signalled when an event is added to the outbox.
+var eventsPending = make(chan struct{}, 1)
+
+func parseEventsURL() (*url.URL, error) {
+	u, err := url.Parse(*eventsURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported scheme %q: must be redis or nats", u.Scheme)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		what := "stream"
+		if u.Scheme == "nats" {
+			what = "subject"
+		}
+		return nil, fmt.Errorf("%q must be of the form %s://host:port/%s", *eventsURL, u.Scheme, what)
+	}
+	return u, nil
+}
+
+// publishEvent adds an event to the outbox, from which the daemon publishes it, if publishing is
+// enabled.
+func publishEvent(e event) {
+	if *eventsURL == "" {
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("[%s] Error generating event ID: %s", e.Feed, err)
+		return
+	}
+	e.ID = hex.EncodeToString(id)
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[%s] Error encoding event: %s", e.Feed, err)
+		return
+	}
+	msg := signedEvent{Event: body}
+	if *eventsSecret != "" {
+		mac := hmac.New(sha256.New, []byte(*eventsSecret))
+		mac.Write(body)
+		msg.Signature = hex.EncodeToString(mac.Sum(nil))
+	}
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[%s] Error encoding event: %s", e.Feed, err)
+		return
+	}
+
+	if _, err := db.Exec("INSERT INTO eventOutbox (eventId, message) VALUES (?, ?)", e.ID, string(encoded)); err != nil {
+		log.Printf("[%s] Error adding event to outbox: %s", e.Feed, err)
+		return
+	}
+	select {
+	case eventsPending <- struct{}{}:
+	default:
+	}
+}
+
+// publishEvents publishes the events in the outbox to the given URL, in order, as they are added.
+// An event is only removed from the outbox once the server has acknowledged it; until then, it is
+// retried over a new connection, with exponential backoff. Events are therefore delivered at least
+// once, including across restarts.
+func publishEvents(u *url.URL) {
+	dial := func() (eventPublisher, error) { return dialEventPublisher(u) }
+	backoff := time.Second
+	for {
+		if err := publishOutbox(dial); err != nil {
+			log.Printf("Error publishing events (retrying in %s): %s", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = time.Second
+		select {
+		case <-eventsPending:
+		case <-time.After(eventsPollInterval):
+		}
+	}
+}
+
+// outboxEvent is an event waiting in the outbox.
+type outboxEvent struct {
+	id      int64
+	eventID string
+	message string
+}
+
+// publishOutbox publishes every event in the outbox, in order, over a connection obtained from
+// dial (if there are any events to publish). Each event is deleted once it has been published.
+func publishOutbox(dial func() (eventPublisher, error)) error {
+	var publisher eventPublisher
+	defer func() {
+		if publisher != nil {
+			publisher.close()
+		}
+	}()
+	for {
+		pending, err := outboxEvents(100)
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+		if publisher == nil {
+			if publisher, err = dial(); err != nil {
+				return err
+			}
+		}
+		for _, e := range pending {
+			if err := publisher.publish(e.eventID, []byte(e.message)); err != nil {
+				return err
+			}
+			if _, err := db.Exec("DELETE FROM eventOutbox WHERE id = ?", e.id); err != nil {
+				return fmt.Errorf("could not remove published event from outbox: %v", err)
+			}
+		}
+	}
+}
+
+// outboxEvents returns up to limit of the oldest events in the outbox.
+func outboxEvents(limit int) ([]outboxEvent, error) {
+	rows, err := db.Query("SELECT id, eventId, message FROM eventOutbox ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		if err := rows.Scan(&e.id, &e.eventID, &e.message); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func dialEventPublisher(u *url.URL) (eventPublisher, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.Trim(u.Path, "/")
+	var publisher eventPublisher
+	if u.Scheme == "redis" {
+		publisher, err = newRedisPublisher(conn, u.User, topic)
+	} else {
+		publisher, err = newNATSPublisher(conn, &tls.Config{ServerName: u.Hostname()}, u.User, topic)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return publisher, nil
+}
+
+// checkEventsReachable verifies that the events endpoint accepts connections (and credentials).
+func checkEventsReachable() error {
+	u, err := parseEventsURL()
+	if err != nil {
+		return err
+	}
+	publisher, err := dialEventPublisher(u)
+	if err != nil {
+		return err
+	}
+	publisher.close()
+	return nil
+}
+
+// redisPublisher publishes to a Redis stream.
+type redisPublisher struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	stream string
+}
+
+func newRedisPublisher(conn net.Conn, user *url.Userinfo, stream string) (*redisPublisher, error) {
+	p := &redisPublisher{conn: conn, r: bufio.NewReader(conn), stream: stream}
+	if user != nil {
+		// Redis accepts either AUTH <password> or, with ACLs, AUTH <username> <password>.
+		args := []string{"AUTH"}
+		if password, ok := user.Password(); !ok {
+			args = append(args, user.Username())
+		} else if user.Username() == "" {
+			args = append(args, password)
+		} else {
+			args = append(args, user.Username(), password)
+		}
+		if _, err := p.command(args...); err != nil {
+			return nil, fmt.Errorf("could not authenticate: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// command sends a command to Redis, returning its reply, which must be a simple string, an
+// integer, or a (non-nil) bulk string.
+func (p *redisPublisher) command(args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	p.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := p.conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+	reply, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	if reply == "" {
+		return "", errors.New("empty reply")
+	}
+	switch reply[0] {
+	case '+', ':':
+		return reply[1:], nil
+	case '-':
+		return "", errors.New(reply[1:])
+	case '$':
+		n, err := strconv.Atoi(reply[1:])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("unexpected reply %q", reply)
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", reply)
+	}
+}
+
+// publish adds the message to the stream. Redis replies with the new entry's ID once it has been
+// added, so the message is retained whether or not any consumer is currently reading the stream.
+func (p *redisPublisher) publish(id string, msg []byte) error {
+	_, err := p.command("XADD", p.stream, "*", "id", id, "event", string(msg))
+	return err
+}
+
+func (p *redisPublisher) close() error {
+	return p.conn.Close()
+}
+
+// natsPublisher publishes to a NATS JetStream subject.
+type natsPublisher struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	subject string
+	inbox   string // prefix of the subjects that JetStream acknowledgements are sent to
+}
+
+// newNATSPublisher sets up a NATS connection over conn, upgrading it to TLS (with the given
+// configuration) if the server requires it.
+func newNATSPublisher(conn net.Conn, tlsConfig *tls.Config, user *url.Userinfo, subject string) (*natsPublisher, error) {
+	p := &natsPublisher{conn: conn, r: bufio.NewReader(conn), subject: subject}
+	p.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return nil, fmt.Errorf("unexpected greeting from server: %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return nil, fmt.Errorf("could not parse server info: %v", err)
+	}
+	if info.TLSRequired {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		p.conn, p.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	if !info.Headers {
+		return nil, errors.New("server does not support headers, which are needed to publish to JetStream")
+	}
+
+	options := map[string]interface{}{
+		"verbose": false, "pedantic": false, "name": "rss-download",
+		"tls_required": info.TLSRequired, "headers": true, "no_responders": true,
+	}
+	if user != nil {
+		options["user"] = user.Username()
+		if password, ok := user.Password(); ok {
+			options["pass"] = password
+		}
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	inbox := make([]byte, 8)
+	if _, err := rand.Read(inbox); err != nil {
+		return nil, err
+	}
+	p.inbox = "_INBOX." + hex.EncodeToString(inbox)
+	if _, err := fmt.Fprintf(p.conn, "CONNECT %s\r\nSUB %s.* 1\r\n", encoded, p.inbox); err != nil {
+		return nil, err
+	}
+	if err := p.flush(); err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+	return p, nil
+}
+
+// flush sends a PING & waits for the server's PONG, which confirms that everything sent before it
+// was accepted.
+func (p *natsPublisher) flush() error {
+	if _, err := p.conn.Write([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// publish publishes the message to JetStream, waiting for the stream to acknowledge it. The
+// message's ID is sent as its Nats-Msg-Id, so that JetStream discards retried duplicates.
+func (p *natsPublisher) publish(id string, msg []byte) error {
+	p.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	header := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s\r\n\r\n", id)
+	reply := p.inbox + "." + id
+	if _, err := fmt.Fprintf(p.conn, "HPUB %s %s %d %d\r\n%s%s\r\n",
+		p.subject, reply, len(header), len(header)+len(msg), header, msg); err != nil {
+		return err
+	}
+
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		switch {
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case len(fields) >= 4 && (fields[0] == "MSG" || fields[0] == "HMSG"):
+			// MSG <subject> <sid> [reply-to] <size>, or
+			// HMSG <subject> <sid> [reply-to] <header size> <total size>.
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("malformed message from server: %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(p.r, payload); err != nil {
+				return err
+			}
+			if fields[1] != reply {
+				continue // an acknowledgement of an earlier message
+			}
+			payload = payload[:size]
+			if fields[0] == "HMSG" {
+				headerSize, err := strconv.Atoi(fields[len(fields)-2])
+				if err != nil || headerSize > size {
+					return fmt.Errorf("malformed message from server: %q", line)
+				}
+				if status := strings.Fields(strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0]); len(status) > 1 {
+					if status[1] == "503" {
+						return fmt.Errorf("no JetStream stream is bound to subject %q", p.subject)
+					}
+					return fmt.Errorf("unexpected status from server: %s", strings.Join(status[1:], " "))
+				}
+				payload = payload[headerSize:]
+			}
+			return parseJetStreamAck(payload)
+		}
+	}
+}
+
+// parseJetStreamAck checks a JetStream publish acknowledgement for errors.
+func parseJetStreamAck(payload []byte) error {
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("could not parse acknowledgement %q: %v", payload, err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("JetStream error %d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("unexpected acknowledgement %q", payload)
+	}
+	return nil
+}
+
+func (p *natsPublisher) close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakePublisher records published messages, failing once it has published failAfter of them.
+type fakePublisher struct {
+	ids, msgs []string
+	failAfter int
+}
+
+func (p *fakePublisher) publish(id string, msg []byte) error {
+	if len(p.msgs) >= p.failAfter {
+		return errors.New("not acknowledged")
+	}
+	p.ids, p.msgs = append(p.ids, id), append(p.msgs, string(msg))
+	return nil
+}
+
+func (p *fakePublisher) close() error { return nil }
+
+func setEventFlags(t *testing.T, url string, secret string) {
+	t.Helper()
+	oldURL, oldSecret := *eventsURL, *eventsSecret
+	t.Cleanup(func() { *eventsURL, *eventsSecret = oldURL, oldSecret })
+	*eventsURL, *eventsSecret = url, secret
+}
+
+func outboxSize(t *testing.T) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM eventOutbox").Scan(&n); err != nil {
+		t.Fatalf("Could not count outbox: %v", err)
+	}
+	return n
+}
+
+func TestPublishOutbox(t *testing.T) {
+	useTestDB(t)
+	setEventFlags(t, "redis://localhost:6379/events", "secret")
+	publishEvent(event{Type: "download", Feed: "feed", Title: "First"})
+	publishEvent(event{Type: "download_failed", Feed: "feed", Title: "Second"})
+	if n := outboxSize(t); n != 2 {
+		t.Fatalf("Outbox holds %d events, want 2", n)
+	}
+
+	// The second event is not acknowledged, so it stays in the outbox.
+	failing := &fakePublisher{failAfter: 1}
+	if err := publishOutbox(func() (eventPublisher, error) { return failing, nil }); err == nil {
+		t.Errorf("publishOutbox succeeded despite an unacknowledged event")
+	}
+	if n := outboxSize(t); n != 1 {
+		t.Errorf("Outbox holds %d events after a failed publish, want 1", n)
+	}
+
+	working := &fakePublisher{failAfter: 100}
+	if err := publishOutbox(func() (eventPublisher, error) { return working, nil }); err != nil {
+		t.Errorf("publishOutbox: %v", err)
+	}
+	if n := outboxSize(t); n != 0 {
+		t.Errorf("Outbox holds %d events after publishing, want 0", n)
+	}
+	if len(working.msgs) != 1 {
+		t.Fatalf("Published %d events, want 1", len(working.msgs))
+	}
+	var msg signedEvent
+	var e event
+	if err := json.Unmarshal([]byte(working.msgs[0]), &msg); err != nil {
+		t.Fatalf("Could not decode message: %v", err)
+	}
+	if err := json.Unmarshal(msg.Event, &e); err != nil {
+		t.Fatalf("Could not decode event: %v", err)
+	}
+	if e.Title != "Second" || e.ID != working.ids[0] || e.ID == failing.ids[0] {
+		t.Errorf("Published event %+v with ID %q, want the second event with its own ID", e, working.ids[0])
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(msg.Event)
+	if want := hex.EncodeToString(mac.Sum(nil)); msg.Signature != want {
+		t.Errorf("Signature = %q, want %q", msg.Signature, want)
+	}
+
+	// Nothing is dialed while the outbox is empty.
+	if err := publishOutbox(func() (eventPublisher, error) { return nil, errors.New("dialed") }); err != nil {
+		t.Errorf("publishOutbox with an empty outbox: %v", err)
+	}
+}
+
+// readRESP reads a command sent to a Redis server.
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, fmt.Errorf("bad array header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad bulk string header %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisPublisher(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for _, want := range []struct {
+			args  string
+			reply string
+		}{
+			{"AUTH user pass", "+OK\r\n"},
+			{"XADD events * id 1 event first", "$15\r\n1700000000000-0\r\n"},
+			{"XADD events * id 2 event second", "-OOM command not allowed when used memory > 'maxmemory'\r\n"},
+		} {
+			args, err := readRESP(r)
+			if err != nil {
+				t.Errorf("Could not read command: %v", err)
+				return
+			}
+			if got := strings.Join(args, " "); got != want.args {
+				t.Errorf("Got command %q, want %q", got, want.args)
+			}
+			server.Write([]byte(want.reply))
+		}
+	}()
+
+	p, err := newRedisPublisher(client, url.UserPassword("user", "pass"), "events")
+	if err != nil {
+		t.Fatalf("newRedisPublisher: %v", err)
+	}
+	if err := p.publish("1", []byte("first")); err != nil {
+		t.Errorf("publish: %v", err)
+	}
+	if err := p.publish("2", []byte("second")); err == nil || !strings.Contains(err.Error(), "OOM") {
+		t.Errorf("publish = %v, want the server's OOM error", err)
+	}
+}
+
+// fakeNATS acts as a NATS server on conn, replying to each published message with the
+// corresponding reply, in which %s is replaced by the message's reply subject.
+func fakeNATS(t *testing.T, conn net.Conn, tlsConfig *tls.Config, replies []string) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"tls_required\":%t}\r\n", tlsConfig != nil)
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("TLS handshake: %v", err)
+			return
+		}
+		conn = tlsConn
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			var options struct {
+				User         string `json:"user"`
+				Headers      bool   `json:"headers"`
+				NoResponders bool   `json:"no_responders"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &options); err != nil {
+				t.Errorf("Could not parse CONNECT: %v", err)
+			}
+			if options.User != "user" || !options.Headers || !options.NoResponders {
+				t.Errorf("Got CONNECT options %+v, want user, headers, and no_responders", options)
+			}
+		case len(fields) == 1 && fields[0] == "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case len(fields) == 5 && fields[0] == "HPUB":
+			size, _ := strconv.Atoi(fields[4])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				t.Errorf("Could not read message: %v", err)
+				return
+			}
+			if !strings.Contains(string(payload), "Nats-Msg-Id: ") {
+				t.Errorf("Message %q has no Nats-Msg-Id header", payload)
+			}
+			if len(replies) == 0 {
+				t.Errorf("Unexpected message %q", payload)
+				return
+			}
+			fmt.Fprintf(conn, replies[0], fields[2])
+			replies = replies[1:]
+		}
+	}
+}
+
+// jetStreamReplies are the replies of a JetStream server to publishes which are acknowledged, which
+// no stream receives, and which are rejected.
+var jetStreamReplies = []string{
+	"MSG %s 1 27\r\n{\"stream\":\"EVENTS\",\"seq\":1}\r\n",
+	"HMSG %s 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\n",
+	"MSG %s 1 64\r\n{\"error\":{\"code\":503,\"description\":\"maximum messages exceeded\"}}\r\n",
+}
+
+func testNATSPublisher(t *testing.T, p *natsPublisher) {
+	t.Helper()
+	if err := p.publish("1", []byte("first")); err != nil {
+		t.Errorf("publish: %v", err)
+	}
+	if err := p.publish("2", []byte("second")); err == nil || !strings.Contains(err.Error(), "no JetStream stream") {
+		t.Errorf("publish with no stream = %v, want a no stream error", err)
+	}
+	if err := p.publish("3", []byte("third")); err == nil || !strings.Contains(err.Error(), "maximum messages exceeded") {
+		t.Errorf("publish rejected by the stream = %v, want the stream's error", err)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeNATS(t, server, nil, jetStreamReplies)
+
+	p, err := newNATSPublisher(client, nil, url.UserPassword("user", "pass"), "rss.events")
+	if err != nil {
+		t.Fatalf("newNATSPublisher: %v", err)
+	}
+	testNATSPublisher(t, p)
+}
+
+func TestNATSPublisherTLS(t *testing.T) {
+	// Borrow httptest's certificate, which is valid for example.com.
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	serverConfig := &tls.Config{Certificates: srv.TLS.Certificates}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	srv.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeNATS(t, server, serverConfig, jetStreamReplies)
+
+	p, err := newNATSPublisher(client, &tls.Config{RootCAs: roots, ServerName: "example.com"}, url.UserPassword("user", "pass"), "rss.events")
+	if err != nil {
+		t.Fatalf("newNATSPublisher: %v", err)
+	}
+	if _, ok := p.conn.(*tls.Conn); !ok {
+		t.Errorf("Connection was not upgraded to TLS")
+	}
+	testNATSPublisher(t, p)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookWaitDelay is how long to wait, once a hook command has exited or been killed, for any
+// processes it started which still hold its output open.
+const hookWaitDelay = 5 * time.Second
+
+// checkHookTimeout verifies that --hook_timeout gives hooks a chance to run.
+func checkHookTimeout() error {
+	if *hookTimeout <= 0 {
+		return fmt.Errorf("--hook_timeout must be positive, got %d", *hookTimeout)
+	}
+	return nil
+}
+
+// runHook runs one of a feed's hook commands, with the given variables added to its environment.
+// The command is killed if it runs longer than --hook_timeout. Its combined output is logged.
+func runHook(name string, kind string, command string, env ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*hookTimeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		log.Printf("[%s] Output of %s hook:\n%s", name, kind, out)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %d seconds", *hookTimeout)
+	}
+	if err != nil {
+		log.Printf("[%s] Error running %s hook: %v", name, kind, err)
+		recordError(name, "hook", fmt.Errorf("%s hook: %v", kind, err))
+	}
+	return err
+}
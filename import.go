@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// seenEntry is an item imported from another tool's record of seen items.
+type seenEntry struct {
+	feed  string
+	title string
+	guid  string
+}
+
+// importSeen imports items that have already been seen, so that they are not downloaded again.
+// Entries are read either from a CSV file of feed,title,guid rows (title,guid rows if --feed is
+// given), or from a FlexGet database, in which each task is taken to be the feed of the same name
+// (unless --feed is given).
+func importSeen(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "csv", "format of the file to import: csv or flexget")
+	feedName := flags.String("feed", "", "if set, import every entry into this feed")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: import [--format=csv|flexget] [--feed=NAME] FILE")
+	}
+	filename := flags.Arg(0)
+
+	var entries []seenEntry
+	var err error
+	switch *format {
+	case "csv":
+		entries, err = readSeenCSV(filename, *feedName)
+	case "flexget":
+		entries, err = readSeenFlexGet(filename, *feedName)
+	default:
+		log.Fatalf("Unknown format %q.", *format)
+	}
+	if err != nil {
+		log.Fatalf("Error reading %q: %s", filename, err)
+	}
+
+	// Normalize titles as the feed would, so that they match the titles of fetched items.
+	feeds, err := loadFeeds()
+	if err != nil {
+		log.Fatalf("Error reading RSS feeds: %s", err)
+	}
+	feedsByName := make(map[string]*feed)
+	for _, f := range feeds {
+		feedsByName[f.name] = f
+	}
+
+	imported := 0
+	unknown := make(map[string]int)
+	for _, entry := range entries {
+		f, ok := feedsByName[entry.feed]
+		if !ok {
+			unknown[entry.feed]++
+			continue
+		}
+		if err := markSeen(f.name, f.normalizeTitle(entry.title), entry.guid); err != nil {
+			log.Fatalf("[%s] Error marking %s as seen: %s", f.name, entry.title, err)
+		}
+		imported++
+	}
+	for name, count := range unknown {
+		log.Printf("[%s] Skipped %d entries: no such feed.", name, count)
+	}
+	log.Printf("Imported %d of %d entries.", imported, len(entries))
+}
+
+func readSeenCSV(filename string, feedName string) ([]seenEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	header := "title"
+	if feedName == "" {
+		header = "feed"
+	}
+	var entries []seenEntry
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && len(record) > 0 && strings.EqualFold(record[0], header) {
+			continue
+		}
+
+		var entry seenEntry
+		if feedName == "" {
+			if len(record) < 2 {
+				line, _ := r.FieldPos(0)
+				log.Printf("Skipping line %d: want feed,title[,guid].", line)
+				continue
+			}
+			entry.feed, record = record[0], record[1:]
+		} else {
+			entry.feed = feedName
+		}
+		entry.title = record[0]
+		if len(record) > 1 {
+			entry.guid = record[1]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func readSeenFlexGet(filename string, feedName string) ([]seenEntry, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	flexget, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	defer flexget.Close()
+
+	rows, err := flexget.Query(`SELECT e.task, e.title, IFNULL(f.value, '') FROM seen_entry e
+		LEFT JOIN seen_field f ON f.seen_entry_id = e.id AND f.field = 'url'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []seenEntry
+	for rows.Next() {
+		var entry seenEntry
+		if err := rows.Scan(&entry.feed, &entry.title, &entry.guid); err != nil {
+			return nil, err
+		}
+		if feedName != "" {
+			entry.feed = feedName
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
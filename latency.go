@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// maxLatencySamples is the number of recent latencies kept for each feed.
+const maxLatencySamples = 500
+
+// latencyQuantiles are the quantiles reported for each feed's latencies.
+var latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// latencyFieldNames name latencyQuantiles in pushed metrics.
+var latencyFieldNames = []string{"latency_p50", "latency_p90", "latency_p99"}
+
+// pubDateLayouts are the formats in which feeds are known to give item publication times. Only
+// numeric zone offsets are parsed: see rfc822Zones.
+var pubDateLayouts = []string{
+	time.RFC1123Z, time.RFC822Z, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700", "2006-01-02 15:04:05",
+}
+
+// rfc822Zones are the offsets of the zone names allowed by RFC 822. time.Parse only knows the
+// offset of a zone name which belongs to the local time zone (treating others as UTC), so these
+// names are replaced by their offsets before parsing. Times with other zone names are not parsed.
+var rfc822Zones = map[string]string{
+	"UT": "+0000", "GMT": "+0000", "Z": "+0000",
+	"EST": "-0500", "EDT": "-0400", "CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600", "PST": "-0800", "PDT": "-0700",
+}
+
+// parsePubDate parses an item's publication time, returning the zero time if it cannot be parsed.
+func parsePubDate(pubDate string) time.Time {
+	pubDate = strings.TrimSpace(pubDate)
+	if pubDate == "" {
+		return time.Time{}
+	}
+	if i := strings.LastIndex(pubDate, " "); i >= 0 {
+		if offset, ok := rfc822Zones[pubDate[i+1:]]; ok {
+			pubDate = pubDate[:i+1] + offset
+		}
+	}
+	for _, layout := range pubDateLayouts {
+		if t, err := time.Parse(layout, pubDate); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// recordLatency records the time from an item's publication to the completion of its download.
+// Only the feed & timings are stored, not which item the latency belongs to.
+func recordLatency(name string, latency time.Duration) {
+	if latency < 0 {
+		// The feed's clock (or ours) is off; the sample would be meaningless.
+		return
+	}
+	if _, err := db.Exec("INSERT INTO latencies (feed, completed, seconds) VALUES (?, ?, ?)",
+		name, time.Now().Unix(), latency.Seconds()); err != nil {
+		log.Printf("[%s] Error recording latency: %s", name, err)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM latencies WHERE feed = ? AND id NOT IN
+		(SELECT id FROM latencies WHERE feed = ? ORDER BY id DESC LIMIT ?)`,
+		name, name, maxLatencySamples); err != nil {
+		log.Printf("[%s] Error trimming latencies: %s", name, err)
+	}
+}
+
+// latencySummary summarizes a feed's recent latencies.
+type latencySummary struct {
+	count     int
+	sum       float64   // seconds
+	quantiles []float64 // seconds, corresponding to latencyQuantiles
+}
+
+func summarizeLatency(name string) (latencySummary, error) {
+	rows, err := db.Query("SELECT seconds FROM latencies WHERE feed = ? ORDER BY seconds", name)
+	if err != nil {
+		return latencySummary{}, err
+	}
+	defer rows.Close()
+
+	var samples []float64
+	var sum float64
+	for rows.Next() {
+		var seconds float64
+		if err := rows.Scan(&seconds); err != nil {
+			return latencySummary{}, err
+		}
+		samples = append(samples, seconds)
+		sum += seconds
+	}
+	if err := rows.Err(); err != nil {
+		return latencySummary{}, err
+	}
+
+	summary := latencySummary{count: len(samples), sum: sum}
+	if len(samples) == 0 {
+		return summary, nil
+	}
+	// The samples are in ascending order.
+	for _, q := range latencyQuantiles {
+		// Nearest-rank quantile.
+		rank := int(math.Ceil(q*float64(len(samples)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		summary.quantiles = append(summary.quantiles, samples[rank])
+	}
+	return summary, nil
+}
+
+// latencyFields returns the latency quantiles of the given feed for pushed metrics, or nothing if
+// latency tracking is disabled or there are no samples.
+func latencyFields(name string) []float64 {
+	if !*trackLatency {
+		return nil
+	}
+	summary, err := summarizeLatency(name)
+	if err != nil {
+		log.Printf("[%s] Error summarizing latency: %s", name, err)
+		return nil
+	}
+	return summary.quantiles
+}
+
+// showStats prints the download statistics & latency percentiles of the named feeds, or of every
+// feed if no names are given.
+func showStats(names []string) {
+	if len(names) == 0 {
+		rows, err := db.Query("SELECT name FROM feeds ORDER BY name")
+		if err != nil {
+			log.Fatalf("Error reading RSS feeds: %s", err)
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				log.Fatalf("Error reading RSS feeds: %s", err)
+			}
+			names = append(names, name)
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("Error reading RSS feeds: %s", err)
+		}
+		rows.Close()
+	}
+
+	for _, name := range names {
+		var downloads, bytes, failures int64
+		if err := db.QueryRow(`SELECT IFNULL(SUM(downloads), 0), IFNULL(SUM(bytes), 0), IFNULL(SUM(failures), 0)
+			FROM dailyStats WHERE feed = ?`, name).Scan(&downloads, &bytes, &failures); err != nil {
+			log.Fatalf("[%s] Error reading statistics: %s", name, err)
+		}
+		summary, err := summarizeLatency(name)
+		if err != nil {
+			log.Fatalf("[%s] Error summarizing latency: %s", name, err)
+		}
+
+		fmt.Printf("[%s] %d downloads (%d bytes), %d failures", name, downloads, bytes, failures)
+		if summary.count > 0 {
+			fmt.Printf("; latency over %d downloads:", summary.count)
+			for i := range latencyQuantiles {
+				fmt.Printf(" %s=%s", strings.TrimPrefix(latencyFieldNames[i], "latency_"), time.Duration(summary.quantiles[i]*float64(time.Second)).Round(time.Second))
+			}
+		}
+		fmt.Println()
+	}
+}
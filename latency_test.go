@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePubDate(t *testing.T) {
+	want := time.Date(2024, 3, 6, 20, 4, 5, 0, time.UTC)
+	for _, pubDate := range []string{
+		"Wed, 06 Mar 2024 15:04:05 EST",
+		"Wed, 06 Mar 2024 12:04:05 PST",
+		"Wed, 06 Mar 2024 20:04:05 GMT",
+		"Wed, 6 Mar 2024 15:04:05 -0500",
+		"2024-03-06T20:04:05Z",
+	} {
+		if got := parsePubDate(pubDate); !got.Equal(want) {
+			t.Errorf("parsePubDate(%q) = %v, want %v", pubDate, got, want)
+		}
+	}
+	// A zone name whose offset is unknown must not be mistaken for UTC.
+	if got := parsePubDate("Wed, 06 Mar 2024 21:04:05 CET"); !got.IsZero() {
+		t.Errorf("parsePubDate with an unknown zone name = %v, want the zero time", got)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockDatabase is a no-op on platforms without flock; single-instance use is not enforced.
+func lockDatabase(path string) (*os.File, error) {
+	return nil, nil
+}
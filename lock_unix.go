@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// lockDatabase takes an advisory lock on the given lock file, so that only one instance uses a
+// database at a time. The lock is held for as long as the returned file remains open.
+func lockDatabase(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			buf := make([]byte, 32)
+			n, _ := file.Read(buf)
+			if pid := strings.TrimSpace(string(buf[:n])); pid != "" {
+				return nil, fmt.Errorf("database is in use by another instance (pid %s)", pid)
+			}
+			return nil, errors.New("database is in use by another instance")
+		}
+		return nil, err
+	}
+
+	// Record our PID, to help identify the instance holding the lock.
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return file, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the per-feed counters.
+const (
+	metricChecks          = "checks"
+	metricCheckErrors     = "check_errors"
+	metricNewItems        = "new_items"
+	metricDownloads       = "downloads"
+	metricDownloadErrors  = "download_errors"
+	metricDownloadedBytes = "downloaded_bytes"
+)
+
+var metricNames = []string{
+	metricChecks, metricCheckErrors, metricNewItems, metricDownloads, metricDownloadErrors, metricDownloadedBytes,
+}
+
+// metrics holds the value of each counter for each feed.
+var metrics = struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64 // feed name -> metric name -> value
+}{counts: make(map[string]map[string]int64)}
+
+func countMetric(feed string, metric string, delta int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	counts, ok := metrics.counts[feed]
+	if !ok {
+		counts = make(map[string]int64)
+		metrics.counts[feed] = counts
+	}
+	counts[metric] += delta
+}
+
+// metricsSnapshot returns a copy of the current counter values, along with the feed names in
+// sorted order.
+func metricsSnapshot() ([]string, map[string]map[string]int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	var feeds []string
+	snapshot := make(map[string]map[string]int64)
+	for feed, counts := range metrics.counts {
+		feeds = append(feeds, feed)
+		snapshot[feed] = make(map[string]int64)
+		for metric, value := range counts {
+			snapshot[feed][metric] = value
+		}
+	}
+	sort.Strings(feeds)
+	return feeds, snapshot
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheusMetrics writes the current metrics in the Prometheus text exposition format.
+func writePrometheusMetrics(w io.Writer) {
+	feeds, snapshot := metricsSnapshot()
+	for _, metric := range metricNames {
+		fmt.Fprintf(w, "# TYPE rss_download_%s_total counter\n", metric)
+		for _, feed := range feeds {
+			fmt.Fprintf(w, "rss_download_%s_total{feed=\"%s\"} %d\n",
+				metric, prometheusLabelEscaper.Replace(feed), snapshot[feed][metric])
+		}
+	}
+
+	if !*trackLatency {
+		return
+	}
+	fmt.Fprint(w, "# TYPE rss_download_latency_seconds summary\n")
+	for _, feed := range feeds {
+		summary, err := summarizeLatency(feed)
+		if err != nil {
+			log.Printf("[%s] Error summarizing latency: %s", feed, err)
+			continue
+		}
+		label := prometheusLabelEscaper.Replace(feed)
+		for i, q := range latencyQuantiles {
+			if summary.count > 0 {
+				fmt.Fprintf(w, "rss_download_latency_seconds{feed=\"%s\",quantile=\"%g\"} %g\n", label, q, summary.quantiles[i])
+			}
+		}
+		fmt.Fprintf(w, "rss_download_latency_seconds_sum{feed=\"%s\"} %g\n", label, summary.sum)
+		fmt.Fprintf(w, "rss_download_latency_seconds_count{feed=\"%s\"} %d\n", label, summary.count)
+	}
+}
+
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// writeInfluxMetrics writes the current metrics in InfluxDB line protocol, one line per feed.
+func writeInfluxMetrics(w io.Writer, tags [][2]string, now time.Time) {
+	feeds, snapshot := metricsSnapshot()
+	for _, feed := range feeds {
+		fmt.Fprintf(w, "rss_download,feed=%s", influxTagEscaper.Replace(feed))
+		for _, tag := range tags {
+			fmt.Fprintf(w, ",%s=%s", influxTagEscaper.Replace(tag[0]), influxTagEscaper.Replace(tag[1]))
+		}
+		for i, metric := range metricNames {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			fmt.Fprintf(w, "%s%s=%di", sep, metric, snapshot[feed][metric])
+		}
+		for i, q := range latencyFields(feed) {
+			fmt.Fprintf(w, ",%s=%g", latencyFieldNames[i], q)
+		}
+		fmt.Fprintf(w, " %d\n", now.UnixNano())
+	}
+}
+
+var graphiteTagEscaper = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\n", "_")
+
+// writeGraphiteMetrics writes the current metrics in the Graphite plaintext protocol, using
+// Graphite tags for the feed name & any extra tags.
+func writeGraphiteMetrics(w io.Writer, tags [][2]string, now time.Time) {
+	var extraTags string
+	for _, tag := range tags {
+		extraTags += fmt.Sprintf(";%s=%s", graphiteTagEscaper.Replace(tag[0]), graphiteTagEscaper.Replace(tag[1]))
+	}
+	feeds, snapshot := metricsSnapshot()
+	for _, feed := range feeds {
+		for _, metric := range metricNames {
+			fmt.Fprintf(w, "rss_download.%s;feed=%s%s %d %d\n",
+				metric, graphiteTagEscaper.Replace(feed), extraTags, snapshot[feed][metric], now.Unix())
+		}
+		for i, q := range latencyFields(feed) {
+			fmt.Fprintf(w, "rss_download.%s;feed=%s%s %g %d\n",
+				latencyFieldNames[i], graphiteTagEscaper.Replace(feed), extraTags, q, now.Unix())
+		}
+	}
+}
+
+// parseMetricsTags parses the value of --metrics_push_tags.
+func parseMetricsTags() ([][2]string, error) {
+	var tags [][2]string
+	for _, pair := range strings.Split(*metricsPushTags, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q: must be key=value", pair)
+		}
+		tags = append(tags, [2]string{kv[0], kv[1]})
+	}
+	return tags, nil
+}
+
+func checkMetricsPush() error {
+	switch *metricsPushFormat {
+	case "influx", "graphite":
+	default:
+		return fmt.Errorf("unknown format %q", *metricsPushFormat)
+	}
+	if *metricsPushAddr == "" {
+		return fmt.Errorf("--metrics_push_addr is required")
+	}
+	if *metricsPushEvery <= 0 {
+		return fmt.Errorf("--metrics_push_interval must be positive")
+	}
+	_, err := parseMetricsTags()
+	return err
+}
+
+// checkMetricsPushReachable verifies that the metrics push endpoint accepts connections.
+func checkMetricsPushReachable() error {
+	addr := *metricsPushAddr
+	if *metricsPushFormat == "influx" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid InfluxDB write URL: %v", err)
+		}
+		addr = u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// pushMetrics periodically pushes the current metrics to --metrics_push_addr.
+func pushMetrics() {
+	tags, err := parseMetricsTags()
+	if err != nil {
+		log.Printf("Error parsing metrics tags: %s", err)
+		return
+	}
+	for now := range time.Tick(time.Duration(*metricsPushEvery) * time.Second) {
+		var buf bytes.Buffer
+		if *metricsPushFormat == "influx" {
+			writeInfluxMetrics(&buf, tags, now)
+			err = pushInflux(&buf)
+		} else {
+			writeGraphiteMetrics(&buf, tags, now)
+			err = pushGraphite(&buf)
+		}
+		if err != nil {
+			log.Printf("Error pushing metrics: %s", err)
+		}
+	}
+}
+
+func pushInflux(body io.Reader) error {
+	resp, err := httpClient.Post(*metricsPushAddr, "text/plain; charset=utf-8", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func pushGraphite(body io.Reader) error {
+	conn, err := net.DialTimeout("tcp", *metricsPushAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = io.Copy(conn, body)
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func dropPrivileges(spec string, files []string) error {
+	return errors.New("--run_as is not supported on this platform")
+}
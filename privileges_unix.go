@@ -0,0 +1,80 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user & group, specified as user:group (or just
+// user, for the user's primary group and, like initgroups, all of the user's supplementary groups).
+// The given files, where they exist, are first given to that user & group.
+func dropPrivileges(spec string, files []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--run_as requires starting as root")
+	}
+
+	userName, groupName := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		userName, groupName = spec[:i], spec[i+1:]
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("unexpected uid %q for user %q", u.Uid, userName)
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("unexpected gid %q", gidStr)
+	}
+	groups := []int{gid}
+	if groupName == "" {
+		groupIDs, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("could not look up groups of user %q: %v", userName, err)
+		}
+		for _, groupID := range groupIDs {
+			g, err := strconv.Atoi(groupID)
+			if err != nil {
+				return fmt.Errorf("unexpected gid %q", groupID)
+			}
+			if g != gid {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	for _, file := range files {
+		if err := os.Lchown(file, uid, gid); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// The group must be changed first, while we still have the privileges to do so.
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("could not set supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("could not set group: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("could not set user: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// recheck re-evaluates the filtered-out items in the most recently fetched contents of each of the
+// named feeds (or of every feed, if no names are given) against the feeds' current filters,
+// downloading any items that now match.
+func recheck(names []string) {
+	feeds, err := loadFeeds()
+	if err != nil {
+		log.Fatalf("Error reading RSS feeds: %s", err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, f := range feeds {
+		if len(wanted) > 0 && !wanted[f.name] {
+			continue
+		}
+		delete(wanted, f.name)
+		if f.mode != modeDownload {
+			log.Printf("[%s] Not rechecking: feed is in %s mode.", f.name, f.mode)
+			continue
+		}
+
+		items, err := filteredItems(f.name)
+		if err != nil {
+			log.Printf("[%s] Error reading cached items: %s", f.name, err)
+			continue
+		}
+		log.Printf("[%s] Rechecking %d filtered items.", f.name, len(items))
+		for _, item := range items {
+			if !f.matches(item.title) {
+				continue
+			}
+
+			log.Printf("[%s] Fetching %s.", f.name, item.title)
+			if err := downloadItem(f, item.title, item.url, time.Time{}, false); err != nil {
+				continue
+			}
+			// The item's GUID is not cached, so it is recorded by link, as items without GUIDs are.
+			if err := markSeen(f.name, item.title, item.url); err != nil {
+				log.Printf("[%s] Error marking %s as seen: %s", f.name, item.title, err)
+			}
+			// The daemon may have re-cached the feed (shifting positions) in the meantime, so the item
+			// is matched the same way cacheItems carries its filtered flag over.
+			if _, err := db.Exec("UPDATE feedItems SET filtered = 0 WHERE feed = ? AND (title = ? OR (url != '' AND url = ?))",
+				f.name, item.title, item.url); err != nil {
+				log.Printf("[%s] Error updating cached item: %s", f.name, err)
+			}
+		}
+	}
+
+	for name := range wanted {
+		log.Printf("[%s] No such feed.", name)
+	}
+}
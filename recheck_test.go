@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecheckAfterLaterCheck(t *testing.T) {
+	useTestDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	*target = t.TempDir()
+	httpClient = srv.Client()
+	requestDelayTicker = time.Tick(time.Millisecond)
+
+	if _, err := db.Exec("INSERT INTO feeds (name, url, dayOfWeek, seconds, lastTitle, include) VALUES (?, ?, 0, 0, '', ?)",
+		"feed", srv.URL+"/feed", "^Wanted"); err != nil {
+		t.Fatalf("Could not add feed: %v", err)
+	}
+	feeds, err := loadFeeds()
+	if err != nil {
+		t.Fatalf("loadFeeds: %v", err)
+	}
+	f := feeds[0]
+	messages := make(chan updatedTitleMessage, 10)
+	first := rssItem{Title: "Unwanted 1", Link: srv.URL + "/unwanted1.torrent"}
+	second := rssItem{Title: "Unwanted 2", Link: srv.URL + "/unwanted2.torrent"}
+
+	// The first check filters out its only item; the second check sees that item again behind a
+	// newly filtered item.
+	if n := processItems(messages, f, []rssItem{first}); n != 1 {
+		t.Errorf("First check found %d new items, want 1", n)
+	}
+	if n := processItems(messages, f, []rssItem{second, first}); n != 1 {
+		t.Errorf("Second check found %d new items, want 1", n)
+	}
+	if items, err := filteredItems("feed"); err != nil || len(items) != 2 {
+		t.Fatalf("filteredItems = %+v, %v; want both items", items, err)
+	}
+
+	// Once the filter is relaxed, recheck downloads both items.
+	if _, err := db.Exec("UPDATE feeds SET include = '' WHERE name = 'feed'"); err != nil {
+		t.Fatalf("Could not update feed: %v", err)
+	}
+	recheck([]string{"feed"})
+	for _, name := range []string{"unwanted1.torrent", "unwanted2.torrent"} {
+		if _, err := os.Stat(filepath.Join(*target, name)); err != nil {
+			t.Errorf("Rechecked item was not downloaded: %v", err)
+		}
+	}
+	if items, err := filteredItems("feed"); err != nil || len(items) != 0 {
+		t.Errorf("After recheck, filteredItems = %+v, %v; want none", items, err)
+	}
+	for _, item := range []rssItem{first, second} {
+		if seen, err := isSeen("feed", item.Title, "", item.Link); err != nil || !seen {
+			t.Errorf("After recheck, isSeen(%q) = %t, %v; want true", item.Title, seen, err)
+		}
+	}
+
+	// A further check must not resurrect the downloaded items.
+	processItems(messages, f, []rssItem{second, first})
+	if items, err := filteredItems("feed"); err != nil || len(items) != 0 {
+		t.Errorf("After another check, filteredItems = %+v, %v; want none", items, err)
+	}
+}
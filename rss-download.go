@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -16,12 +21,9 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/ungerik/go-rss"
+	"golang.org/x/net/html/charset"
 )
 
-// CREATE TABLE feeds (name TEXT PRIMARY KEY, url TEXT NOT NULL, dayOfWeek INTEGER NOT NULL,
-// seconds INTEGER NOT NULL, lastTitle TEXT NOT NULL);
-
 type updatedTitleMessage struct {
 	Name  string
 	Title string
@@ -34,52 +36,165 @@ var (
 	checkInterval      = flag.Int("check_interval", 3600, "seconds between checks during normal operation")
 	rapidCheckInterval = flag.Int("rapid_check_interval", 60, "seconds between checks when we suspect there will be a new item")
 	rapidCheckDuration = flag.Int("rapid_check_duration", 3600, "seconds that we suspect there will be a new item")
+	rapidMaxDuration   = flag.Int("rapid_max_duration", 43200, "maximum seconds to keep checking rapidly while waiting for a feed's expected items")
+	rapidGraceDuration = flag.Int("rapid_grace_duration", 0, "seconds to keep checking, with decaying frequency, after a rapid window in which no new item appeared")
+	rapidGraceBackoff  = flag.Float64("rapid_grace_backoff", 2, "factor by which the check interval grows on each check during the rapid grace period")
 	downloadDelay      = flag.Int("download_delay", 30, "seconds to wait before downloading the file")
 	requestDelay       = flag.Int("request_delay", 5, "seconds to wait between requests")
 	checkImmediate     = flag.Bool("check_immediately", false, "if set, check immediately on startup")
-	updateCommand      = flag.String("update_command", "", "command to run after an update is noticed")
+	updateCommand      = flag.String("update_command", "", "command to run for each new item that is noticed")
 	download           = flag.Bool("download", true, "if unset, do not actually download files")
+	errorRetention     = flag.Int("error_retention", 100, "number of recent errors to keep in the database for each feed")
+	watchdogGrace      = flag.Int("watchdog_grace", 900, "seconds a check may run, or a download may go without receiving data, before it is considered stuck (0 to disable)")
+	alertCommand       = flag.String("alert_command", "", "command to run when a feed's watcher appears to be stuck")
+	http2              = flag.Bool("http2", true, "if set, use HTTP/2 when servers support it")
+	maxIdleConns       = flag.Int("max_idle_conns_per_host", 2, "maximum number of idle connections to keep open to each host")
+	keepAlive          = flag.Int("keep_alive", 90, "seconds to keep idle connections open for reuse (0 to disable keep-alive)")
+	adminAddr          = flag.String("admin_addr", "", "address to serve the admin API on, as host:port or unix:/path/to/socket (empty to disable)")
+	adminSocketMode    = flag.String("admin_socket_mode", "0600", "file mode of the admin API's unix socket")
+	metricsPushFormat  = flag.String("metrics_push_format", "", "format to push metrics in: influx or graphite (empty to disable)")
+	metricsPushAddr    = flag.String("metrics_push_addr", "", "where to push metrics: an InfluxDB write URL, or a Graphite host:port")
+	metricsPushEvery   = flag.Int("metrics_push_interval", 60, "seconds between metrics pushes")
+	metricsPushTags    = flag.String("metrics_push_tags", "", "extra tags to attach to pushed metrics, as comma-separated key=value pairs")
+	snapshotDir        = flag.String("snapshot_dir", "", "directory to save compressed snapshots of fetched feeds to (empty to disable)")
+	snapshotRetention  = flag.Int("snapshot_retention", 100, "number of snapshots to keep for each feed")
+	hookTimeout        = flag.Int("hook_timeout", 300, "seconds a feed's success or failure hook may run before it is killed")
+	hookFailureFails   = flag.Bool("hook_failure_fails_item", false, "if set, an item whose success hook fails is treated as failed")
+	eventsURL          = flag.String("events_url", "", "where to publish download events: redis://host:port/stream or nats://host:port/subject (empty to disable)")
+	eventsSecret       = flag.String("events_secret", "", "if set, key used to sign published events with HMAC-SHA256")
+	trackLatency       = flag.Bool("track_latency", false, "if set, record the time from each item's publication to the completion of its download")
+	force              = flag.Bool("force", false, "if set, start even if another instance appears to be using the database")
+	runAs              = flag.String("run_as", "", "if set, user[:group] to switch to after initialization, when started as root")
+	checkEndpoints     = flag.Bool("check_endpoints", false, "if set, the self-check also verifies that the metrics push & events endpoints are reachable")
+	dirMode            = flag.String("dir_mode", "0755", "file mode of directories created under the target directory")
 )
 
 var requestDelayTicker <-chan time.Time
 
-func downloadUrl(url string) error {
+// httpClient is used for all requests, so that connections are reused across checks & downloads.
+var httpClient *http.Client
+
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     *http2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   *maxIdleConns,
+		IdleConnTimeout:       time.Duration(*keepAlive) * time.Second,
+		DisableKeepAlives:     *keepAlive <= 0,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+	}
+	if !*http2 {
+		// A non-nil, empty TLSNextProto map disables HTTP/2.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// rssItem is the subset of an RSS item that we care about.
+type rssItem struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	PubDate string `xml:"pubDate"`
+	GUID    string `xml:"guid"`
+}
+
+// fetchFeed fetches & parses the RSS feed at the given URL. The raw body of the response is
+// returned if one was received, even if it could not be parsed. The request is abandoned if the
+// given context is cancelled.
+func fetchFeed(ctx context.Context, url string) ([]rssItem, []byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc struct {
+		Channel struct {
+			Item []rssItem `xml:"item"`
+		} `xml:"channel"`
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, raw, err
+	}
+	return doc.Channel.Item, raw, nil
+}
+
+// downloadUrl downloads the given URL into the given directory, returning the path downloaded to
+// and the number of bytes downloaded. The downloaded data is also written to progress as it is
+// received, and the download is abandoned if the given context is cancelled. The caller is
+// responsible for waiting for the request delay.
+func downloadUrl(ctx context.Context, url string, dir string, progress io.Writer) (string, int64, error) {
 	if !*download {
-		return errors.New("downloading disabled by flag")
+		return "", 0, errors.New("downloading disabled by flag")
 	}
 
 	// Figure out the filename to download to.
 	lastSeparatorIndex := strings.LastIndex(url, "/")
 	if lastSeparatorIndex == -1 {
-		return errors.New("malformed url (no slash!?)")
+		return "", 0, errors.New("malformed url (no slash!?)")
 	}
 	filename := url[lastSeparatorIndex+1:]
 	if len(filename) == 0 {
-		return errors.New("malformed url (no filename)")
+		return "", 0, errors.New("malformed url (no filename)")
 	}
-	path := filepath.Join(*target, filename)
-	if path == *target || !strings.HasPrefix(path, *target) {
-		return fmt.Errorf("invalid download filename: %s", filename)
+	path := filepath.Join(dir, filename)
+	if path == dir || !strings.HasPrefix(path, dir) {
+		return "", 0, fmt.Errorf("invalid download filename: %s", filename)
 	}
 
 	// Actually download it.
-	<-requestDelayTicker
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("could not download %q: %v", url, err)
+		return path, 0, fmt.Errorf("could not download %q: %v", url, err)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return path, 0, fmt.Errorf("could not download %q: %v", url, err)
 	}
 	defer resp.Body.Close()
 
 	file, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("could not open %q: %v", path, err)
+		return path, 0, fmt.Errorf("could not open %q: %v", path, err)
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(file, resp.Body); err != nil {
-		return fmt.Errorf("could not download %q to %q: %v", url, path, err)
+	n, err := io.Copy(file, io.TeeReader(resp.Body, progress))
+	if err != nil {
+		return path, n, fmt.Errorf("could not download %q to %q: %v", url, path, err)
+	}
+	return path, n, nil
+}
+
+// recordDownload records the outcome of a download attempt in the metrics & statistics.
+func recordDownload(name string, bytes int64, err error) {
+	countMetric(name, metricDownloadedBytes, bytes)
+	if err != nil {
+		countMetric(name, metricDownloadErrors, 1)
+	} else {
+		countMetric(name, metricDownloads, 1)
+	}
+	if err := recordDailyStats(name, bytes, err != nil); err != nil {
+		log.Printf("[%s] Error recording statistics: %s", name, err)
 	}
-	return nil
 }
 
 func lastRapidStartTime(fromTime time.Time, dayOfWeek int, seconds int) time.Time {
@@ -107,11 +222,15 @@ func isRapid(fromTime time.Time, dayOfWeek int, seconds int) bool {
 	return fromTime.Equal(rapidStartTime) || (fromTime.After(rapidStartTime) && fromTime.Before(rapidStartTime.Add(time.Duration(*rapidCheckDuration)*time.Second)))
 }
 
-func nextCheckTime(lastCheckTime time.Time, dayOfWeek int, seconds int) time.Time {
+// nextCheckTime determines when to check after lastCheckTime. If extendedInterval is nonzero, it
+// is used in place of the normal check interval outside of the rapid window.
+func nextCheckTime(lastCheckTime time.Time, dayOfWeek int, seconds int, extendedInterval time.Duration) time.Time {
 	var nextCheckTime time.Time
 
 	if isRapid(lastCheckTime, dayOfWeek, seconds) {
 		nextCheckTime = lastCheckTime.Add(time.Duration(*rapidCheckInterval) * time.Second)
+	} else if extendedInterval > 0 {
+		nextCheckTime = lastCheckTime.Add(extendedInterval)
 	} else {
 		nextCheckTime = lastCheckTime.Add(time.Duration(*checkInterval) * time.Second)
 	}
@@ -124,6 +243,82 @@ func nextCheckTime(lastCheckTime time.Time, dayOfWeek int, seconds int) time.Tim
 	return nextCheckTime
 }
 
+// rapidWindow counts the new items a feed has had since its most recent rapid start time, so that
+// rapid checking can be extended until the feed's expected items have arrived. The count is kept
+// in memory only, so it restarts from zero if the daemon is restarted.
+type rapidWindow struct {
+	start       time.Time
+	items       int
+	graceChecks int // checks made so far during the grace period after the rapid window
+}
+
+// observe records that a check of the feed at the given time found the given number of new items.
+func (rw *rapidWindow) observe(f *feed, checkTime time.Time, newItems int) {
+	if start := lastRapidStartTime(checkTime, f.dayOfWeek, f.seconds); !start.Equal(rw.start) {
+		rw.start = start
+		rw.items = 0
+		rw.graceChecks = 0
+	}
+	rw.items += newItems
+	if rw.inGracePeriod(f, checkTime) {
+		rw.graceChecks++
+	}
+}
+
+// end returns the end of the feed's rapid window: the end of the rapid check duration or, for feeds
+// with an expected number of items, the end of the maximum rapid duration if that is later.
+func (rw *rapidWindow) end(f *feed) time.Time {
+	end := rw.start.Add(time.Duration(*rapidCheckDuration) * time.Second)
+	if maxEnd := rw.start.Add(time.Duration(*rapidMaxDuration) * time.Second); f.expectedItems > 0 && maxEnd.After(end) {
+		end = maxEnd
+	}
+	return end
+}
+
+func (rw *rapidWindow) inGracePeriod(f *feed, checkTime time.Time) bool {
+	end := rw.end(f)
+	return !checkTime.Before(end) && checkTime.Before(end.Add(time.Duration(*rapidGraceDuration)*time.Second))
+}
+
+// extension determines the check interval to use after a check at the given time if the feed's
+// rapid checking should be extended past the end of its rapid window, or 0 if it should not.
+// While fewer than the feed's expected items have arrived, checking continues at the rapid check
+// interval until the maximum rapid duration has passed. Then, if the expected items (or, for feeds
+// without an expected count, any item) still have not arrived, checking continues for the grace
+// period: the first check in the grace period is followed by another after the rapid check
+// interval, and the interval grows by the grace backoff factor on each later check.
+func (rw *rapidWindow) extension(f *feed, checkTime time.Time) time.Duration {
+	rapidInterval := time.Duration(*rapidCheckInterval) * time.Second
+	if f.expectedItems > 0 && rw.items < f.expectedItems &&
+		checkTime.Before(rw.start.Add(time.Duration(*rapidMaxDuration)*time.Second)) {
+		return rapidInterval
+	}
+
+	expected := f.expectedItems
+	if expected == 0 {
+		expected = 1
+	}
+	if rw.items >= expected || !rw.inGracePeriod(f, checkTime) {
+		return 0
+	}
+	interval := float64(rapidInterval) * math.Pow(*rapidGraceBackoff, float64(rw.graceChecks-1))
+	if normalInterval := float64(time.Duration(*checkInterval) * time.Second); interval > normalInterval {
+		interval = normalInterval
+	}
+	return time.Duration(interval)
+}
+
+// checkRapidGrace verifies that the rapid grace period's settings are usable.
+func checkRapidGrace() error {
+	if *rapidGraceDuration < 0 {
+		return fmt.Errorf("--rapid_grace_duration must not be negative, got %d", *rapidGraceDuration)
+	}
+	if *rapidGraceBackoff < 1 {
+		return fmt.Errorf("--rapid_grace_backoff must be at least 1, got %g", *rapidGraceBackoff)
+	}
+	return nil
+}
+
 func firstCheckTime(startTime time.Time, dayOfWeek int, seconds int) time.Time {
 	// Grab info from last rapid start time.
 	baseTime := lastRapidStartTime(startTime, dayOfWeek, seconds)
@@ -149,59 +344,207 @@ func firstCheckTime(startTime time.Time, dayOfWeek int, seconds int) time.Time {
 	return nextCheckTime
 }
 
-func watchFeed(
-	messages chan updatedTitleMessage, name string, feedUrl string, dayOfWeek int, seconds int,
-	lastTitle string) {
-	log.Printf("[%s] Starting watch.", name)
+// triageItem applies the feed's filters & mode to a new item, logging the outcome. It determines
+// whether the item should be fetched, and whether it was rejected by the filters.
+func triageItem(f *feed, title string) (fetch bool, filtered bool) {
+	if !f.matches(title) {
+		log.Printf("[%s] Skipping %s (filtered).", f.name, title)
+		return false, true
+	}
+	if f.mode != modeDownload {
+		log.Printf("[%s] Noticed %s.", f.name, title)
+		return false, false
+	}
+	log.Printf("[%s] Fetching %s.", f.name, title)
+	return true, false
+}
+
+// fetchItem downloads an item of the given feed, after waiting for the download delay. published
+// is the item's publication time, or the zero time if it is unknown; injected is true if the item
+// was injected by the inject command.
+func fetchItem(f *feed, title string, url string, published time.Time, injected bool) error {
+	if *downloadDelay > 0 {
+		time.Sleep(time.Duration(*downloadDelay) * time.Second)
+	}
+	return downloadItem(f, title, url, published, injected)
+}
+
+// downloadItem downloads an item of the given feed, running the feed's success or failure hook
+// and recording the outcome. published is the item's publication time, or the zero time if it is
+// unknown. The downloads of injected items are marked as such in their events, and are left out of
+// the metrics & statistics.
+func downloadItem(f *feed, title string, url string, published time.Time, injected bool) error {
+	var path string
+	var n int64
+	dir, err := f.downloadDir(title)
+	if err == nil {
+		// Wait for our turn before starting the watchdog's clock.
+		<-requestDelayTicker
+		ctx, d := beginDownload(f.name, url)
+		path, n, err = downloadUrl(ctx, url, dir, d)
+		d.end()
+	}
+	env := []string{
+		fmt.Sprintf("RSSD_NAME=%s", f.name),
+		fmt.Sprintf("RSSD_TITLE=%s", title),
+		fmt.Sprintf("RSSD_URL=%s", url),
+		fmt.Sprintf("RSSD_PATH=%s", path),
+	}
+	if err == nil && f.onSuccess != "" {
+		if hookErr := runHook(f.name, "success", f.onSuccess, env...); hookErr != nil && *hookFailureFails {
+			err = fmt.Errorf("success hook failed: %v", hookErr)
+		}
+	}
+	if err != nil && f.onFailure != "" {
+		runHook(f.name, "failure", f.onFailure, append(env, fmt.Sprintf("RSSD_ERROR=%s", err))...)
+	}
+	if !injected {
+		recordDownload(f.name, n, err)
+		if err == nil && *trackLatency && !published.IsZero() {
+			recordLatency(f.name, time.Since(published))
+		}
+	}
+	e := event{Type: "download", Feed: f.name, Title: title, URL: url, Path: path, Bytes: n, Injected: injected, Time: time.Now()}
+	if err != nil {
+		e.Type, e.Error = "download_failed", err.Error()
+	}
+	publishEvent(e)
+
+	if err != nil {
+		log.Printf("[%s] Error fetching %s: %s", f.name, url, err)
+		recordError(f.name, "download", err)
+		return err
+	}
+	log.Printf("[%s] Fetched %s.", f.name, title)
+	return nil
+}
+
+// processItems handles the items of a successful check of the feed: new items are triaged (and
+// fetched, if appropriate), the items are cached for rechecking, and the feed's last seen title is
+// updated. It returns the number of new items.
+func processItems(messages chan updatedTitleMessage, f *feed, rssItems []rssItem) int {
+	// Normalize titles before comparing or storing them.
+	for i := range rssItems {
+		rssItems[i].Title = f.normalizeTitle(rssItems[i].Title)
+	}
+
+	// Download any new files that pass the filters.
+	items := make([]cachedItem, len(rssItems))
+	newItems := 0
+	seenLast := false
+	for i := 0; i < len(rssItems); i++ {
+		items[i] = cachedItem{position: i, title: rssItems[i].Title, url: rssItems[i].Link}
+		if seenLast || rssItems[i].Title == f.lastTitle {
+			seenLast = true
+			continue
+		}
+		guid := rssItems[i].GUID
+		if guid == "" {
+			guid = rssItems[i].Link
+		}
+		if seen, err := isSeen(f.name, rssItems[i].Title, guid, rssItems[i].Link); err != nil {
+			log.Printf("[%s] Error checking whether %s was seen: %s", f.name, rssItems[i].Title, err)
+		} else if seen {
+			log.Printf("[%s] Skipping %s (already seen).", f.name, rssItems[i].Title)
+			continue
+		}
+		countMetric(f.name, metricNewItems, 1)
+		newItems++
+
+		fetch, filtered := triageItem(f, rssItems[i].Title)
+		items[i].filtered = filtered
+		if fetch {
+			go fetchItem(f, rssItems[i].Title, rssItems[i].Link, parsePubDate(rssItems[i].PubDate), false)
+		}
+		if !filtered {
+			if err := markSeen(f.name, rssItems[i].Title, guid); err != nil {
+				log.Printf("[%s] Error marking %s as seen: %s", f.name, rssItems[i].Title, err)
+			}
+			if f.mode != modeRecord {
+				go runUpdateCommand(f.name, rssItems[i].Title)
+			}
+		}
+	}
+
+	// Remember this check's items, so that they can be rechecked later.
+	if err := cacheItems(f.name, items); err != nil {
+		log.Printf("[%s] Error caching items: %s", f.name, err)
+	}
+
+	// Update last seen title.
+	if len(rssItems) > 0 {
+		newTitle := rssItems[0].Title
+		if f.lastTitle != newTitle {
+			f.lastTitle = newTitle
+			messages <- updatedTitleMessage{f.name, f.lastTitle}
+		}
+	}
+
+	return newItems
+}
+
+func watchFeed(messages chan updatedTitleMessage, f *feed, w *watcher) {
+	log.Printf("[%s] Starting watch.", f.name)
 
 	var checkTime time.Time
 	if *checkImmediate {
 		checkTime = time.Now()
 	} else {
-		checkTime = firstCheckTime(time.Now(), dayOfWeek, seconds)
+		checkTime = firstCheckTime(time.Now(), f.dayOfWeek, f.seconds)
 	}
 
 	// Main loop.
+	var window rapidWindow
 	for {
 		// Wait until the next check time.
+		w.expect(checkTime)
 		time.Sleep(checkTime.Sub(time.Now()))
-		checkTime = nextCheckTime(checkTime, dayOfWeek, seconds)
+		newItems := 0
 
 		// Fetch RSS.
 		<-requestDelayTicker
-		log.Printf("[%s] Checking for new items.", name)
-		feed, err := rss.Read(feedUrl)
+		log.Printf("[%s] Checking for new items.", f.name)
+		ctx := w.begin()
+		rssItems, raw, err := fetchFeed(ctx, f.url)
+		w.end()
+		if raw != nil && *snapshotDir != "" {
+			if err := saveSnapshot(f.name, raw, time.Now()); err != nil {
+				log.Printf("[%s] Error saving snapshot: %s", f.name, err)
+				recordError(f.name, "snapshot", err)
+			}
+		}
+		countMetric(f.name, metricChecks, 1)
 		if err != nil {
-			log.Printf("[%s] Error fetching RSS: %s", name, err)
+			log.Printf("[%s] Error fetching RSS: %s", f.name, err)
+			recordError(f.name, "fetch", err)
+			countMetric(f.name, metricCheckErrors, 1)
 		} else {
-			// Download any new files.
-			for i := 0; i < len(feed.Item); i++ {
-				if feed.Item[i].Title == lastTitle {
-					break
-				}
-
-				log.Printf("[%s] Fetching %s.", name, feed.Item[i].Title)
-				go func(title string, url string) {
-					if *downloadDelay > 0 {
-						time.Sleep(time.Duration(*downloadDelay) * time.Second)
-					}
-					if err := downloadUrl(url); err != nil {
-						log.Printf("[%s] Error fetching %s: %s", name, url, err)
-					} else {
-						log.Printf("[%s] Fetched %s.", name, title)
-					}
-				}(feed.Item[i].Title, feed.Item[i].Link)
-			}
-
-			// Update last seen title.
-			if len(feed.Item) > 0 {
-				newTitle := feed.Item[0].Title
-				if lastTitle != newTitle {
-					lastTitle = newTitle
-					messages <- updatedTitleMessage{name, lastTitle}
-				}
-			}
+			newItems = processItems(messages, f, rssItems)
 		}
+
+		// Schedule the next check.
+		window.observe(f, checkTime, newItems)
+		checkTime = nextCheckTime(checkTime, f.dayOfWeek, f.seconds, window.extension(f, checkTime))
+	}
+}
+
+// runCommand runs the given command, with the given variables added to its environment.
+func runCommand(command string, env ...string) error {
+	cmd := exec.Command(command)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Run()
+}
+
+// runUpdateCommand runs the update command, if any, to notify that the given feed has a new item.
+func runUpdateCommand(name string, title string) {
+	if len(*updateCommand) == 0 {
+		return
+	}
+	if err := runCommand(*updateCommand,
+		fmt.Sprintf("RSSD_NAME=%s", name),
+		fmt.Sprintf("RSSD_TITLE=%s", title)); err != nil {
+		log.Printf("[%s] Error running update command: %v", name, err)
+		recordError(name, "command", fmt.Errorf("update command: %v", err))
 	}
 }
 
@@ -212,37 +555,116 @@ func main() {
 		log.Fatal("--target is required.")
 	}
 
-	log.Print("Starting rss-downloader.")
 	requestDelayTicker = time.Tick(time.Duration(*requestDelay) * time.Second)
+	httpClient = newHTTPClient()
+
+	// Make sure no other daemon is using the database.
+	daemon := flag.NArg() == 0
+	lockFilename := *dbFilename + ".lock"
+	if daemon {
+		lockFile, err := lockDatabase(lockFilename)
+		if err != nil {
+			if !*force {
+				log.Fatalf("Error locking database: %s (use --force to start anyway)", err)
+			}
+			log.Printf("Error locking database: %s; starting anyway due to --force.", err)
+		}
+		if lockFile != nil {
+			defer lockFile.Close()
+		}
+	}
 
 	// Connect to database.
-	db, err := sql.Open("sqlite3", *dbFilename)
+	var err error
+	db, err = sql.Open("sqlite3", *dbFilename)
 	if err != nil {
 		log.Fatalf("Error opening database connection: %s", err)
 	}
 	defer db.Close()
+	if flag.Arg(0) != "check" {
+		// The check command reports on the database as it is, rather than migrating it.
+		if err := migrateDB(); err != nil {
+			log.Fatalf("Error updating database: %s", err)
+		}
+	}
 
-	// Start watching.
-	messages := make(chan updatedTitleMessage)
-	rows, err := db.Query("SELECT name, url, dayOfWeek, seconds, lastTitle FROM feeds")
-	if err != nil {
-		log.Fatalf("Error reading RSS feeds: %s", err)
+	// Listen for the admin API before dropping privileges, as it may use a privileged port.
+	var adminListener net.Listener
+	if daemon && *adminAddr != "" {
+		adminListener, err = listenAdmin(*adminAddr)
+		if err != nil {
+			log.Fatalf("Error listening for admin API: %s", err)
+		}
+		defer adminListener.Close()
+	}
+	if *runAs != "" {
+		// The files we keep writing to must belong to the unprivileged user.
+		owned := []string{*dbFilename, *dbFilename + "-journal", *dbFilename + "-wal", *dbFilename + "-shm", lockFilename}
+		if adminListener != nil && strings.HasPrefix(*adminAddr, "unix:") {
+			owned = append(owned, strings.TrimPrefix(*adminAddr, "unix:"))
+		}
+		if err := dropPrivileges(*runAs, owned); err != nil {
+			log.Fatalf("Error dropping privileges: %s", err)
+		}
+		log.Printf("Running as %s.", *runAs)
 	}
-	for rows.Next() {
-		var name string
-		var url string
-		var dayOfWeek int
-		var seconds int
-		var lastTitle string
 
-		if err := rows.Scan(&name, &url, &dayOfWeek, &seconds, &lastTitle); err != nil {
-			log.Fatalf("Error reading RSS feeds: %s", err)
+	if *eventsURL != "" {
+		u, err := parseEventsURL()
+		if err != nil {
+			log.Fatalf("Error starting event publishing: %s", err)
 		}
+		// Other commands only add events to the outbox; the daemon publishes them.
+		if daemon {
+			go publishEvents(u)
+		}
+	}
 
-		go watchFeed(messages, name, url, dayOfWeek, seconds, lastTitle)
+	// Run a one-off command, if one was given.
+	if !daemon {
+		switch flag.Arg(0) {
+		case "check":
+			selfCheck()
+		case "errors":
+			showErrors(flag.Args()[1:])
+		case "import":
+			importSeen(flag.Args()[1:])
+		case "inject":
+			inject(flag.Args()[1:])
+		case "stats":
+			showStats(flag.Args()[1:])
+		case "recheck":
+			recheck(flag.Args()[1:])
+		default:
+			log.Fatalf("Unknown command %q.", flag.Arg(0))
+		}
+		return
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatalf("Error reading RSS feeds: %s", err)
+
+	log.Print("Starting rss-downloader.")
+	feeds := selfCheck()
+
+	// Start watching.
+	messages := make(chan updatedTitleMessage)
+	watchers := make(map[string]*watcher)
+	for _, f := range feeds {
+		w := &watcher{}
+		watchers[f.name] = w
+		go watchFeed(messages, f, w)
+	}
+	if *watchdogGrace > 0 {
+		go watchdog(watchers)
+	}
+	if *metricsPushFormat != "" {
+		go pushMetrics()
+	}
+	if adminListener != nil {
+		go func() {
+			log.Printf("Serving admin API on %s.", *adminAddr)
+			if err := http.Serve(adminListener, adminHandler(watchers)); err != nil {
+				log.Printf("Error serving admin API: %s", err)
+			}
+		}()
 	}
 
 	for {
@@ -251,17 +673,5 @@ func main() {
 		if err != nil {
 			log.Printf("[%s] Error updating last title: %s", msg.Name, err)
 		}
-
-		if len(*updateCommand) > 0 {
-			go func() {
-				cmd := exec.Command(*updateCommand)
-				cmd.Env = append(os.Environ(),
-					fmt.Sprintf("RSSD_NAME=%s", msg.Name),
-					fmt.Sprintf("RSSD_TITLE=%s", msg.Title))
-				if err := cmd.Run(); err != nil {
-					log.Printf("[%s] Error running update command: %v", msg.Name, err)
-				}
-			}()
-		}
 	}
 }
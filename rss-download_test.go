@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setRapidFlags sets the scheduling flags for the duration of the test.
+func setRapidFlags(t *testing.T, graceDuration int, graceBackoff float64) {
+	t.Helper()
+	oldInterval, oldRapidInterval, oldDuration, oldMax := *checkInterval, *rapidCheckInterval, *rapidCheckDuration, *rapidMaxDuration
+	oldGraceDuration, oldGraceBackoff := *rapidGraceDuration, *rapidGraceBackoff
+	t.Cleanup(func() {
+		*checkInterval, *rapidCheckInterval, *rapidCheckDuration, *rapidMaxDuration = oldInterval, oldRapidInterval, oldDuration, oldMax
+		*rapidGraceDuration, *rapidGraceBackoff = oldGraceDuration, oldGraceBackoff
+	})
+	*checkInterval, *rapidCheckInterval, *rapidCheckDuration, *rapidMaxDuration = 3600, 60, 3600, 43200
+	*rapidGraceDuration, *rapidGraceBackoff = graceDuration, graceBackoff
+}
+
+// checkIntervals simulates the checks a feed's watch loop makes from the given rapid start time
+// until the given time, with the given number of new items found by each check at the given
+// offsets (in seconds) from the start time. It returns the interval (in seconds) scheduled after
+// each check, keyed by the check's offset from the start time.
+func checkIntervals(f *feed, start time.Time, until time.Duration, newItems map[int]int) map[int]int {
+	intervals := make(map[int]int)
+	var window rapidWindow
+	for checkTime := start; checkTime.Before(start.Add(until)); {
+		offset := int(checkTime.Sub(start) / time.Second)
+		window.observe(f, checkTime, newItems[offset])
+		next := nextCheckTime(checkTime, f.dayOfWeek, f.seconds, window.extension(f, checkTime))
+		intervals[offset] = int(next.Sub(checkTime) / time.Second)
+		checkTime = next
+	}
+	return intervals
+}
+
+func testFeed(start time.Time, expectedItems int) *feed {
+	return &feed{name: "feed", dayOfWeek: int(start.Weekday()), seconds: 20 * 3600, expectedItems: expectedItems}
+}
+
+func TestRapidGracePeriod(t *testing.T) {
+	setRapidFlags(t, 3600, 2)
+	start := time.Date(2024, 3, 6, 20, 0, 0, 0, time.Local)
+	f := testFeed(start, 0)
+
+	intervals := checkIntervals(f, start, 3*time.Hour, nil)
+	if got := intervals[3540]; got != 60 {
+		t.Errorf("Interval after the last rapid check = %d, want 60", got)
+	}
+	// The grace period starts with the first check at the end of the rapid window, and its
+	// intervals start at the rapid check interval.
+	offset := 3600
+	for _, want := range []int{60, 120, 240, 480, 960, 1920} {
+		got, ok := intervals[offset]
+		if !ok {
+			t.Fatalf("No check at offset %d; intervals: %v", offset, intervals)
+		}
+		if got != want {
+			t.Errorf("Interval after the grace check at offset %d = %d, want %d", offset, got, want)
+		}
+		offset += got
+	}
+	// The grace period is over once it has lasted --rapid_grace_duration seconds.
+	if got := intervals[offset]; got != 3600 {
+		t.Errorf("Interval after the grace period (at offset %d) = %d, want 3600", offset, got)
+	}
+}
+
+func TestRapidGracePeriodEndsWithNewItem(t *testing.T) {
+	setRapidFlags(t, 3600, 2)
+	start := time.Date(2024, 3, 6, 20, 0, 0, 0, time.Local)
+	f := testFeed(start, 0)
+
+	intervals := checkIntervals(f, start, 3*time.Hour, map[int]int{3660: 1})
+	if got := intervals[3600]; got != 60 {
+		t.Errorf("Interval after the first grace check = %d, want 60", got)
+	}
+	if got := intervals[3660]; got != 3600 {
+		t.Errorf("Interval after a grace check found an item = %d, want 3600", got)
+	}
+}
+
+func TestRapidGracePeriodAfterExpectedItemsExtension(t *testing.T) {
+	setRapidFlags(t, 3600, 2)
+	start := time.Date(2024, 3, 6, 20, 0, 0, 0, time.Local)
+	f := testFeed(start, 2)
+
+	// Only one of the two expected items arrives, so rapid checking continues until the maximum
+	// rapid duration, and the grace period follows that.
+	intervals := checkIntervals(f, start, 14*time.Hour, map[int]int{60: 1})
+	for _, offset := range []int{3600, 43140} {
+		if got := intervals[offset]; got != 60 {
+			t.Errorf("Interval after the extended rapid check at offset %d = %d, want 60", offset, got)
+		}
+	}
+	offset := 43200
+	for _, want := range []int{60, 120, 240} {
+		got, ok := intervals[offset]
+		if !ok {
+			t.Fatalf("No check at offset %d", offset)
+		}
+		if got != want {
+			t.Errorf("Interval after the grace check at offset %d = %d, want %d", offset, got, want)
+		}
+		offset += got
+	}
+}
+
+func TestRapidWithoutGracePeriod(t *testing.T) {
+	setRapidFlags(t, 0, 2)
+	start := time.Date(2024, 3, 6, 20, 0, 0, 0, time.Local)
+	f := testFeed(start, 0)
+
+	intervals := checkIntervals(f, start, 3*time.Hour, nil)
+	if got := intervals[3600]; got != 3600 {
+		t.Errorf("Interval after the rapid window = %d, want 3600", got)
+	}
+}
+
+func TestCheckRapidGrace(t *testing.T) {
+	setRapidFlags(t, 3600, 0.5)
+	if err := checkRapidGrace(); err == nil {
+		t.Errorf("checkRapidGrace accepted a backoff below 1")
+	}
+	*rapidGraceBackoff = 1
+	if err := checkRapidGrace(); err != nil {
+		t.Errorf("checkRapidGrace rejected a backoff of 1: %v", err)
+	}
+}
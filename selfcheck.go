@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// selfCheck verifies that the environment & configuration are usable before any feeds are
+// watched, logging a summary of every check. If any check fails, it exits; otherwise, it returns
+// the configured feeds.
+func selfCheck() []*feed {
+	failures := 0
+	report := func(what string, err error) {
+		if err != nil {
+			failures++
+			log.Printf("Self-check: %s: FAILED: %s", what, err)
+		} else {
+			log.Printf("Self-check: %s: ok", what)
+		}
+	}
+
+	report(fmt.Sprintf("target directory %q", *target), checkWritableDir(*target))
+	_, err := parseDirMode()
+	report("directory mode", err)
+	// The check command opens the database without migrating it, so it is not created until it is
+	// first queried.
+	schemaErr := checkDatabaseFile()
+	report(fmt.Sprintf("database %q", *dbFilename), schemaErr)
+	if schemaErr == nil {
+		schemaErr = checkSchema()
+		report("database schema", schemaErr)
+	}
+	if *rapidGraceDuration != 0 {
+		report("rapid grace period", checkRapidGrace())
+	}
+	if *snapshotDir != "" {
+		report(fmt.Sprintf("snapshot directory %q", *snapshotDir), checkWritableDir(*snapshotDir))
+		report("snapshot retention", checkSnapshotRetention())
+	}
+	if *updateCommand != "" {
+		_, err := exec.LookPath(*updateCommand)
+		report("update command", err)
+	}
+	if *alertCommand != "" {
+		_, err := exec.LookPath(*alertCommand)
+		report("alert command", err)
+	}
+	report("hook timeout", checkHookTimeout())
+	report("error retention", checkErrorRetention())
+
+	if *metricsPushFormat != "" {
+		err := checkMetricsPush()
+		report("metrics push", err)
+		if err == nil && *checkEndpoints {
+			report(fmt.Sprintf("metrics push endpoint %q", *metricsPushAddr), checkMetricsPushReachable())
+		}
+	}
+	if *eventsURL != "" && *checkEndpoints {
+		report("events endpoint", checkEventsReachable())
+	}
+
+	// Feeds can only be read once the schema is up to date.
+	var feeds []*feed
+	if schemaErr == nil {
+		var err error
+		feeds, err = loadFeeds()
+		for _, f := range feeds {
+			report(fmt.Sprintf("feed %q", f.name), checkFeed(f))
+		}
+		if err != nil {
+			report("feeds", err)
+		} else if len(feeds) == 0 {
+			report("feeds", errors.New("no feeds are configured (is --db_file correct?)"))
+		}
+	}
+
+	if failures > 0 {
+		log.Fatalf("Self-check failed: %d problems found.", failures)
+	}
+	log.Printf("Self-check passed: %d feeds ready.", len(feeds))
+	return feeds
+}
+
+// checkWritableDir verifies that dir is an existing, writable directory.
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	file, err := os.CreateTemp(dir, ".rss-download-check-")
+	if err != nil {
+		return fmt.Errorf("%q is not writable: %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkDatabaseFile verifies that the database file exists, rather than letting SQLite create an
+// empty one.
+func checkDatabaseFile() error {
+	if _, err := os.Stat(*dbFilename); os.IsNotExist(err) {
+		return fmt.Errorf("%q does not exist", *dbFilename)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkSchema verifies that the database schema is up to date. The check command does not migrate
+// the database, so it reports an out of date schema here rather than changing it.
+func checkSchema() error {
+	version, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("schema version is %d, want %d (it is migrated when rss-download starts)", version, len(migrations))
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version is %d, newer than this version of rss-download supports (%d)", version, len(migrations))
+	}
+	return nil
+}
+
+// checkFeed verifies the parts of a feed's configuration that depend on the environment.
+func checkFeed(f *feed) error {
+	if err := f.checkDirectory(); err != nil {
+		return err
+	}
+	for _, command := range []string{f.onSuccess, f.onFailure} {
+		if command == "" {
+			continue
+		}
+		if _, err := exec.LookPath(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
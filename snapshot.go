@@ -0,0 +1,92 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotSuffix = ".xml.gz"
+
+// saveSnapshot saves a gzip-compressed copy of the given feed's raw contents to --snapshot_dir,
+// then removes the feed's oldest snapshots beyond --snapshot_retention. Snapshots are stored as
+// <snapshot_dir>/<feed>-<hash>/<UTC fetch time>.xml.gz.
+func saveSnapshot(name string, raw []byte, fetchTime time.Time) error {
+	dir := filepath.Join(*snapshotDir, snapshotSubdir(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fetchTime.UTC().Format("20060102T150405Z")+snapshotSuffix)
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(file)
+	if _, err := gz.Write(raw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Enforce retention. Snapshot filenames sort chronologically.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), snapshotSuffix) {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	sort.Strings(snapshots)
+	for len(snapshots) > *snapshotRetention {
+		if err := os.Remove(filepath.Join(dir, snapshots[0])); err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// checkSnapshotRetention verifies that --snapshot_retention keeps at least one snapshot.
+func checkSnapshotRetention() error {
+	if *snapshotRetention <= 0 {
+		return fmt.Errorf("--snapshot_retention must be positive, got %d", *snapshotRetention)
+	}
+	return nil
+}
+
+// snapshotSubdir returns the name of the directory holding the given feed's snapshots. A short
+// hash of the feed name is appended, so that feeds whose names only differ in characters which
+// are unsafe in filenames (e.g. "a b" and "a_b") do not share a directory.
+func snapshotSubdir(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return safeFilename(name) + "-" + hex.EncodeToString(hash[:4])
+}
+
+// safeFilename returns a version of s that is safe to use as a single path component, using only
+// ASCII letters, digits, '-', '_', and '.'.
+func safeFilename(s string) string {
+	return sanitizePathComponent(s, func(r rune) bool {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return false
+		default:
+			return true
+		}
+	})
+}
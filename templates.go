@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the helper functions available to every template.
+var templateFuncs = template.FuncMap{
+	// sanitize makes s safe to use as a single path component, replacing unsafe characters (and
+	// escaping names such as "..") while keeping it readable.
+	"sanitize": func(s string) string {
+		return sanitizePathComponent(s, func(r rune) bool {
+			return r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r)
+		})
+	},
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	// date formats a time using a Go reference-time layout, e.g. "2006-01-02".
+	"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	// regexExtract returns the first capture group of the first match of pattern in s (or the whole
+	// match, if the pattern has no groups), or the empty string if there is no match.
+	"regexExtract": func(pattern, s string) (string, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		match := re.FindStringSubmatch(s)
+		switch {
+		case match == nil:
+			return "", nil
+		case len(match) > 1:
+			return match[1], nil
+		default:
+			return match[0], nil
+		}
+	},
+}
+
+// parseTemplate parses a template with access to templateFuncs, then validates it by executing it
+// with the given sample data, so that mistakes such as misspelled fields, bad function arguments,
+// or invalid regular expressions surface when the configuration is loaded rather than at runtime.
+func parseTemplate(name string, text string, sample interface{}) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("template failed on sample data: %v", err)
+	}
+	return tmpl, nil
+}
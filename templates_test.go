@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, test := range []struct{ title, want string }{
+		{"Show: Part 1/2", "Show_ Part 1_2"},
+		{"Café", "Café"},
+		{".", "_."},
+		{"..", "_.."},
+		{"", "_"},
+	} {
+		tmpl, err := parseTemplate("directory", "TV/{{.Title | sanitize}}", struct{ Title string }{})
+		if err != nil {
+			t.Fatalf("parseTemplate: %v", err)
+		}
+		var got strings.Builder
+		if err := tmpl.Execute(&got, struct{ Title string }{test.title}); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		if want := "TV/" + test.want; got.String() != want {
+			t.Errorf("Rendered title %q as %q, want %q", test.title, got.String(), want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// activeDownload tracks an in-progress download, so that the watchdog can notice when it stops
+// making progress (e.g. because the server stopped sending data without closing the connection).
+type activeDownload struct {
+	feed         string
+	url          string
+	cancel       context.CancelFunc
+	mu           sync.Mutex
+	lastProgress time.Time // time the download started, or most recently received data
+}
+
+// activeDownloads holds the in-progress downloads of every feed.
+var activeDownloads = struct {
+	mu     sync.Mutex
+	active map[*activeDownload]bool
+}{active: make(map[*activeDownload]bool)}
+
+// beginDownload notes that a download of the given URL has started, returning a context which is
+// cancelled if the watchdog decides the download is stuck. As with watcher.begin, it must be called
+// only once the download has its turn to make a request. Data received by the download should
+// be written to the returned activeDownload, and its end method called once the download is done.
+func beginDownload(feed string, url string) (context.Context, *activeDownload) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &activeDownload{feed: feed, url: url, cancel: cancel, lastProgress: time.Now()}
+	activeDownloads.mu.Lock()
+	defer activeDownloads.mu.Unlock()
+	activeDownloads.active[d] = true
+	return ctx, d
+}
+
+// Write notes that the download has received the given data.
+func (d *activeDownload) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastProgress = time.Now()
+	return len(p), nil
+}
+
+// end notes that the download has finished.
+func (d *activeDownload) end() {
+	activeDownloads.mu.Lock()
+	defer activeDownloads.mu.Unlock()
+	delete(activeDownloads.active, d)
+	d.cancel()
+}
+
+// stalledDownloads cancels & returns the in-progress downloads which have received no data for the
+// watchdog grace period.
+func stalledDownloads(now time.Time) []*activeDownload {
+	activeDownloads.mu.Lock()
+	defer activeDownloads.mu.Unlock()
+	var stalled []*activeDownload
+	for d := range activeDownloads.active {
+		d.mu.Lock()
+		lastProgress := d.lastProgress
+		d.mu.Unlock()
+		if now.Sub(lastProgress) < time.Duration(*watchdogGrace)*time.Second {
+			continue
+		}
+		d.cancel()
+		delete(activeDownloads.active, d)
+		stalled = append(stalled, d)
+	}
+	return stalled
+}
+
+// watcher tracks the activity of a feed's watch loop, so that the watchdog can notice when the
+// loop gets stuck (e.g. in a network call that never completes).
+type watcher struct {
+	mu        sync.Mutex
+	lastCheck time.Time          // time the most recent check finished
+	nextCheck time.Time          // time the next check is scheduled for
+	deadline  time.Time          // time by which the current check should have finished; zero between checks
+	cancel    context.CancelFunc // cancels the in-progress check; nil if no check is in progress
+}
+
+// expect notes that the next check is scheduled for the given time. The loop is not expected to
+// make progress until then.
+func (w *watcher) expect(checkTime time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextCheck = checkTime
+	w.deadline = time.Time{}
+}
+
+// begin notes that a check has started, returning a context which is cancelled if the watchdog
+// decides the check is stuck. The check must be started only once it has its turn to make a
+// request, so that time spent waiting behind other requests does not count against it.
+func (w *watcher) begin() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancel = cancel
+	w.deadline = time.Now().Add(time.Duration(*watchdogGrace) * time.Second)
+	return ctx
+}
+
+// end notes that the check started by begin has finished.
+func (w *watcher) end() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastCheck = time.Now()
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+// unstick cancels any in-progress check if the watcher has missed its deadline, returning true if
+// it had. The deadline is pushed back so that a watcher which stays stuck is reported once per
+// grace period rather than on every pass of the watchdog.
+func (w *watcher) unstick(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if *watchdogGrace <= 0 || w.deadline.IsZero() || now.Before(w.deadline) {
+		return false
+	}
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	w.deadline = now.Add(time.Duration(*watchdogGrace) * time.Second)
+	return true
+}
+
+func watchdog(watchers map[string]*watcher) {
+	for now := range time.Tick(time.Minute) {
+		for name, w := range watchers {
+			if !w.unstick(now) {
+				continue
+			}
+
+			log.Printf("[%s] Watcher appears to be stuck; cancelling its current check.", name)
+			recordError(name, "watchdog", errors.New("watcher stuck; cancelled its current check"))
+			go runAlertCommand(name, "stuck")
+		}
+		for _, d := range stalledDownloads(now) {
+			log.Printf("[%s] Download of %s appears to be stuck; cancelling it.", d.feed, d.url)
+			recordError(d.feed, "watchdog", fmt.Errorf("download of %s stuck; cancelled it", d.url))
+			go runAlertCommand(d.feed, "stuck_download", fmt.Sprintf("RSSD_URL=%s", d.url))
+		}
+	}
+}
+
+// runAlertCommand runs the alert command, if any, to alert that the given feed has a problem of
+// the given kind.
+func runAlertCommand(name string, kind string, env ...string) {
+	if len(*alertCommand) == 0 {
+		return
+	}
+	env = append([]string{fmt.Sprintf("RSSD_NAME=%s", name), fmt.Sprintf("RSSD_ALERT=%s", kind)}, env...)
+	if err := runCommand(*alertCommand, env...); err != nil {
+		log.Printf("[%s] Error running alert command: %v", name, err)
+		recordError(name, "command", fmt.Errorf("alert command: %v", err))
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatcherDeadlineStartsWithCheck(t *testing.T) {
+	old := *watchdogGrace
+	t.Cleanup(func() { *watchdogGrace = old })
+	*watchdogGrace = 900
+
+	// A loop waiting for its turn (e.g. behind queued downloads) long after its scheduled check time
+	// is not stuck.
+	var w watcher
+	w.expect(time.Now().Add(-time.Hour))
+	if w.unstick(time.Now()) {
+		t.Errorf("Watcher waiting to start its check was reported as stuck")
+	}
+
+	ctx := w.begin()
+	if w.unstick(time.Now().Add(899 * time.Second)) {
+		t.Errorf("Watcher was reported as stuck before its grace period passed")
+	}
+	if !w.unstick(time.Now().Add(901 * time.Second)) {
+		t.Errorf("Watcher was not reported as stuck after its grace period passed")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("Stuck check was not cancelled")
+	}
+}